@@ -2,6 +2,7 @@ package config
 
 import (
 	"log"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -14,6 +15,9 @@ type Environment struct {
 	Cloudflare Cloudflare
 	Redis      Redis
 	Docker     Docker
+	Build      Build
+	Artifacts  Artifacts
+	Edge       Edge
 }
 
 type AppData struct {
@@ -22,6 +26,9 @@ type AppData struct {
 	Port      string
 	Debug     bool
 	JWTSecret string
+	// EncryptionKey encrypts secrets stored in the database, such as
+	// webhook secrets
+	EncryptionKey string
 }
 
 type Database struct {
@@ -38,6 +45,26 @@ type GitHub struct {
 	ClientID     string
 	ClientSecret string
 	RedirectURL  string
+	// WebhookURL is the public URL of /webhooks/github, registered as a
+	// webhook on the repositories apps are created from
+	WebhookURL string
+	// APIURL is the base URL of the GitHub REST API, which can point at a
+	// GitHub Enterprise Server or a fake one in tests
+	APIURL string
+	// App is the GitHub App repositories are accessed as, if the server
+	// runs as one
+	App GitHubApp
+}
+
+// GitHubApp configures the GitHub App the server runs as. Without an ID,
+// repositories are accessed with the OAuth tokens of app owners.
+type GitHubApp struct {
+	ID int64
+	// PrivateKeyPath is the PEM file of a private key of the app, which its
+	// JWTs are signed with
+	PrivateKeyPath string
+	// WebhookSecret is the secret of the app's webhook
+	WebhookSecret string
 }
 
 type Cloudflare struct {
@@ -53,7 +80,80 @@ type Redis struct {
 }
 
 type Docker struct {
-	Host string
+	Host       string
+	BuildImage string
+	// NodeImage and HugoImage build Node and Hugo sites; everything else
+	// uses BuildImage
+	NodeImage string
+	HugoImage string
+	CPUs      string
+	Memory    string
+	PidsLimit int
+}
+
+type Build struct {
+	Executor string
+	Timeouts BuildTimeouts
+	// MaxConcurrent caps the builds running at once across all workers
+	MaxConcurrent int
+	// MaxConcurrentPerUser caps the builds running at once for one user
+	MaxConcurrentPerUser int
+	// FlutterSDKDir holds one Flutter SDK per subdirectory, named by version
+	// or channel, for the host executor
+	FlutterSDKDir string
+	// CacheDir keeps dependencies between builds; empty disables the cache
+	CacheDir string
+	// CacheMaxSize is the size in bytes the cache is trimmed to, least
+	// recently used entries first
+	CacheMaxSize int64
+	// MirrorDir keeps a bare mirror of every repository built; empty has
+	// builds clone from the network
+	MirrorDir string
+	// MirrorMaxAge is how long a mirror is kept after its last build
+	MirrorMaxAge time.Duration
+}
+
+type Artifacts struct {
+	// Store is where deployments are uploaded: local or s3
+	Store string
+	// LocalDir holds the deployments of the local store
+	LocalDir string
+	// BaseURL is the public URL of the store's root, if it isn't the
+	// store's own
+	BaseURL string
+	S3      S3
+}
+
+// S3 configures an S3-compatible object store, such as AWS S3, Cloudflare
+// R2 or MinIO
+type S3 struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// PathStyle addresses the bucket in the path rather than the host name,
+	// which MinIO needs
+	PathStyle bool
+}
+
+// Edge configures the server that serves deployed apps
+type Edge struct {
+	// Port is where apps are served; empty disables the edge server
+	Port string
+	// CacheTTL is how long which deployment an app serves is cached, and
+	// so how long a promotion takes to go live
+	CacheTTL time.Duration
+}
+
+// BuildTimeouts bounds how long a build may run, overall and per step.
+// Apps can override any of them.
+type BuildTimeouts struct {
+	Total        time.Duration
+	Clone        time.Duration
+	Dependencies time.Duration
+	Build        time.Duration
+	Upload       time.Duration
 }
 
 func LoadEnvironment() *Environment {
@@ -72,11 +172,12 @@ func LoadEnvironment() *Environment {
 
 	return &Environment{
 		AppData: AppData{
-			Name:      viper.GetString("APPLICATION_NAME"),
-			Env:       viper.GetString("APPLICATION_ENV"),
-			Port:      viper.GetString("APPLICATION_PORT"),
-			Debug:     viper.GetBool("DEBUG"),
-			JWTSecret: viper.GetString("JWT_SECRET"),
+			Name:          viper.GetString("APPLICATION_NAME"),
+			Env:           viper.GetString("APPLICATION_ENV"),
+			Port:          viper.GetString("APPLICATION_PORT"),
+			Debug:         viper.GetBool("DEBUG"),
+			JWTSecret:     viper.GetString("JWT_SECRET"),
+			EncryptionKey: viper.GetString("ENCRYPTION_KEY"),
 		},
 		Database: Database{
 			ConnectionString: viper.GetString("MONGO_DB_CONNECTION_STRING"),
@@ -90,6 +191,13 @@ func LoadEnvironment() *Environment {
 			ClientID:     viper.GetString("GITHUB_CLIENT_ID"),
 			ClientSecret: viper.GetString("GITHUB_CLIENT_SECRET"),
 			RedirectURL:  viper.GetString("GITHUB_REDIRECT_URL"),
+			WebhookURL:   viper.GetString("GITHUB_WEBHOOK_URL"),
+			APIURL:       viper.GetString("GITHUB_API_URL"),
+			App: GitHubApp{
+				ID:             viper.GetInt64("GITHUB_APP_ID"),
+				PrivateKeyPath: viper.GetString("GITHUB_APP_PRIVATE_KEY_PATH"),
+				WebhookSecret:  viper.GetString("GITHUB_APP_WEBHOOK_SECRET"),
+			},
 		},
 		Cloudflare: Cloudflare{
 			APIToken:  viper.GetString("CLOUDFLARE_API_TOKEN"),
@@ -102,7 +210,47 @@ func LoadEnvironment() *Environment {
 			DB:       viper.GetInt("REDIS_DB"),
 		},
 		Docker: Docker{
-			Host: viper.GetString("DOCKER_HOST"),
+			Host:       viper.GetString("DOCKER_HOST"),
+			BuildImage: viper.GetString("DOCKER_BUILD_IMAGE"),
+			NodeImage:  viper.GetString("DOCKER_NODE_IMAGE"),
+			HugoImage:  viper.GetString("DOCKER_HUGO_IMAGE"),
+			CPUs:       viper.GetString("DOCKER_BUILD_CPUS"),
+			Memory:     viper.GetString("DOCKER_BUILD_MEMORY"),
+			PidsLimit:  viper.GetInt("DOCKER_BUILD_PIDS_LIMIT"),
+		},
+		Build: Build{
+			Executor:      viper.GetString("BUILD_EXECUTOR"),
+			FlutterSDKDir: viper.GetString("FLUTTER_SDK_DIR"),
+			CacheDir:      viper.GetString("BUILD_CACHE_DIR"),
+			CacheMaxSize:  int64(viper.GetSizeInBytes("BUILD_CACHE_MAX_SIZE")),
+			MirrorDir:     viper.GetString("BUILD_MIRROR_DIR"),
+			MirrorMaxAge:  viper.GetDuration("BUILD_MIRROR_MAX_AGE"),
+			Timeouts: BuildTimeouts{
+				Total:        viper.GetDuration("BUILD_TIMEOUT"),
+				Clone:        viper.GetDuration("BUILD_TIMEOUT_CLONE"),
+				Dependencies: viper.GetDuration("BUILD_TIMEOUT_DEPENDENCIES"),
+				Build:        viper.GetDuration("BUILD_TIMEOUT_BUILD"),
+				Upload:       viper.GetDuration("BUILD_TIMEOUT_UPLOAD"),
+			},
+			MaxConcurrent:        viper.GetInt("BUILD_MAX_CONCURRENT"),
+			MaxConcurrentPerUser: viper.GetInt("BUILD_MAX_CONCURRENT_PER_USER"),
+		},
+		Artifacts: Artifacts{
+			Store:    viper.GetString("ARTIFACT_STORE"),
+			LocalDir: viper.GetString("ARTIFACT_DIR"),
+			BaseURL:  viper.GetString("ARTIFACT_BASE_URL"),
+			S3: S3{
+				Endpoint:        viper.GetString("S3_ENDPOINT"),
+				Region:          viper.GetString("S3_REGION"),
+				Bucket:          viper.GetString("S3_BUCKET"),
+				AccessKeyID:     viper.GetString("S3_ACCESS_KEY_ID"),
+				SecretAccessKey: viper.GetString("S3_SECRET_ACCESS_KEY"),
+				PathStyle:       viper.GetBool("S3_FORCE_PATH_STYLE"),
+			},
+		},
+		Edge: Edge{
+			Port:     viper.GetString("EDGE_PORT"),
+			CacheTTL: viper.GetDuration("EDGE_CACHE_TTL"),
 		},
 	}
 }
@@ -118,8 +266,33 @@ func setDefaults() {
 	viper.SetDefault("APP_DOMAIN", "breezy.app")
 	viper.SetDefault("FRONTEND_URL", "http://localhost:3000")
 	viper.SetDefault("GITHUB_REDIRECT_URL", "http://localhost:3000/auth/github/callback")
+	viper.SetDefault("GITHUB_API_URL", "https://api.github.com")
 	viper.SetDefault("REDIS_ADDR", "localhost:6379")
 	viper.SetDefault("REDIS_PASSWORD", "")
 	viper.SetDefault("REDIS_DB", 0)
 	viper.SetDefault("DOCKER_HOST", "unix:///var/run/docker.sock")
+	viper.SetDefault("DOCKER_BUILD_IMAGE", "ghcr.io/cirruslabs/flutter:3.24.5")
+	viper.SetDefault("DOCKER_NODE_IMAGE", "node:20-bookworm")
+	viper.SetDefault("DOCKER_HUGO_IMAGE", "hugomods/hugo:exts-0.134.3")
+	viper.SetDefault("DOCKER_BUILD_CPUS", "2")
+	viper.SetDefault("DOCKER_BUILD_MEMORY", "4g")
+	viper.SetDefault("DOCKER_BUILD_PIDS_LIMIT", 1024)
+	viper.SetDefault("BUILD_EXECUTOR", "docker")
+	viper.SetDefault("BUILD_TIMEOUT", "30m")
+	viper.SetDefault("BUILD_TIMEOUT_CLONE", "5m")
+	viper.SetDefault("BUILD_TIMEOUT_DEPENDENCIES", "10m")
+	viper.SetDefault("BUILD_TIMEOUT_BUILD", "20m")
+	viper.SetDefault("BUILD_TIMEOUT_UPLOAD", "5m")
+	viper.SetDefault("BUILD_MAX_CONCURRENT", 2)
+	viper.SetDefault("BUILD_MAX_CONCURRENT_PER_USER", 1)
+	viper.SetDefault("BUILD_CACHE_DIR", "./cache")
+	viper.SetDefault("BUILD_CACHE_MAX_SIZE", "10GB")
+	viper.SetDefault("BUILD_MIRROR_DIR", "./mirrors")
+	viper.SetDefault("BUILD_MIRROR_MAX_AGE", "168h")
+	viper.SetDefault("ARTIFACT_STORE", "local")
+	viper.SetDefault("ARTIFACT_DIR", "./artifacts")
+	viper.SetDefault("S3_REGION", "us-east-1")
+	viper.SetDefault("S3_FORCE_PATH_STYLE", false)
+	viper.SetDefault("EDGE_PORT", "8081")
+	viper.SetDefault("EDGE_CACHE_TTL", "5s")
 }
@@ -1,6 +1,7 @@
 package controller
 
 import (
+	"breezy/config"
 	"breezy/middleware"
 	"breezy/model"
 	"breezy/services"
@@ -15,22 +16,33 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var (
-	buildService *services.BuildService
-	db           *mongo.Database
+	buildService     *services.BuildService
+	appGitHubService *services.GitHubService
+	db               *mongo.Database
+	appConfigEnv     *config.Environment
 )
 
-func AppController(router fiber.Router, database *mongo.Database) {
+func AppController(router fiber.Router, env *config.Environment, database *mongo.Database, builds *services.BuildService) {
 	db = database
+	appConfigEnv = env
+	buildService = builds
+	appGitHubService = services.NewGitHubService(env, database)
 	router.Post("/", middleware.ValidateAccessToken, validation.ValidateUserIDFromLocals, validation.ValidateCreateAppRequest, createApp)
 	router.Get("/", middleware.ValidateAccessToken, validation.ValidateUserIDFromLocals, getUserApps)
 	router.Get("/:id", middleware.ValidateAccessToken, validation.ValidateUserIDFromLocals, validation.ValidateAppID, validation.ValidateAppOwnership, getAppById)
-	router.Put("/:id", middleware.ValidateAccessToken, validation.ValidateUserIDFromLocals, validation.ValidateAppID, validation.ValidateAppOwnership, updateApp)
+	router.Put("/:id", middleware.ValidateAccessToken, validation.ValidateUserIDFromLocals, validation.ValidateAppID, validation.ValidateAppOwnership, validation.ValidateUpdateAppRequest, updateApp)
 	router.Delete("/:id", middleware.ValidateAccessToken, validation.ValidateUserIDFromLocals, validation.ValidateAppID, validation.ValidateAppOwnership, deleteApp)
 	router.Post("/:id/deploy", middleware.ValidateAccessToken, validation.ValidateUserIDFromLocals, validation.ValidateAppID, validation.ValidateAppOwnership, validation.ValidateDeployAppRequest, deployApp)
 	router.Get("/:id/status", middleware.ValidateAccessToken, validation.ValidateUserIDFromLocals, validation.ValidateAppID, validation.ValidateAppOwnership, getAppStatus)
+	router.Get("/:id/previews", middleware.ValidateAccessToken, validation.ValidateUserIDFromLocals, validation.ValidateAppID, validation.ValidateAppOwnership, getAppPreviews)
+	router.Get("/:id/webhooks/deliveries", middleware.ValidateAccessToken, validation.ValidateUserIDFromLocals, validation.ValidateAppID, validation.ValidateAppOwnership, getAppWebhookDeliveries)
+	router.Post("/:id/webhooks/deliveries/:deliveryId/replay", middleware.ValidateAccessToken, validation.ValidateUserIDFromLocals, validation.ValidateAppID, validation.ValidateAppOwnership, validation.ValidateAppWebhookDeliveryID, replayWebhookDelivery)
+	router.Get("/:id/promotions", middleware.ValidateAccessToken, validation.ValidateUserIDFromLocals, validation.ValidateAppID, validation.ValidateAppOwnership, getAppPromotions)
+	router.Post("/:id/deployments/:deploymentId/promote", middleware.ValidateAccessToken, validation.ValidateUserIDFromLocals, validation.ValidateAppID, validation.ValidateAppOwnership, validation.ValidateAppDeploymentID, promoteDeployment)
 }
 
 func createApp(c *fiber.Ctx) error {
@@ -55,11 +67,22 @@ func createApp(c *fiber.Ctx) error {
 		Name:          request.Name,
 		SanitizedName: sanitizedName,
 		Description:   request.Description,
+		Branch:        request.Branch,
+		AutoDeploy:    true,
 		IsActive:      true,
 		CreatedAt:     time.Now(),
 		UpdatedAt:     time.Now(),
 	}
 
+	// Linking the repository lets its webhooks find the app
+	if request.RepoURL != "" {
+		if repository, err := appGitHubService.LinkRepository(userID, request.RepoURL); err != nil {
+			logrus.WithError(err).Warnf("Failed to link repository %s to new app %s", request.RepoURL, app.Id.Hex())
+		} else {
+			app.RepositoryId = repository.Id
+		}
+	}
+
 	// Save app to database
 	collection := db.Collection("apps")
 	_, err = collection.InsertOne(context.Background(), app)
@@ -68,14 +91,15 @@ func createApp(c *fiber.Ctx) error {
 		return utils.InternalServerErrorResponse(c, "Failed to create app")
 	}
 
-	// Start the build process if repo URL is provided
+	// Queue the first build if repo URL is provided
+	buildScheduled := false
 	if request.RepoURL != "" && buildService != nil {
-		go func() {
-			// Small delay to ensure app is created first
-			time.Sleep(1 * time.Second)
-			buildService.StartBuild(app.Id.Hex(), userID, request.RepoURL, request.Branch)
-			logrus.Infof("Started build for new app %s, user %s, repo %s", app.Id.Hex(), userID, request.RepoURL)
-		}()
+		if job, err := buildService.EnqueueBuild(app.Id.Hex(), userID, request.RepoURL, request.Branch, services.BuildOptions{}); err != nil {
+			logrus.WithError(err).Errorf("Failed to queue build for new app %s", app.Id.Hex())
+		} else {
+			buildScheduled = true
+			logrus.Infof("Queued build %s for new app %s, user %s, repo %s", job.Id, app.Id.Hex(), userID, request.RepoURL)
+		}
 	}
 
 	return utils.SuccessResponseWithData(c, "App created successfully", fiber.Map{
@@ -85,8 +109,11 @@ func createApp(c *fiber.Ctx) error {
 			"sanitizedName":  app.SanitizedName,
 			"description":    app.Description,
 			"isActive":       app.IsActive,
+			"branch":         app.Branch,
+			"autoDeploy":     app.AutoDeploy,
+			"url":            appURL(app),
 			"createdAt":      app.CreatedAt,
-			"buildScheduled": request.RepoURL != "",
+			"buildScheduled": buildScheduled,
 		},
 		"user_id":  userID,
 		"repo_url": request.RepoURL,
@@ -118,6 +145,11 @@ func sanitizeAppName(name string) string {
 		resultStr = strings.ReplaceAll(resultStr, "--", "-")
 	}
 
+	// Keep it short enough to be a host name label
+	if len(resultStr) > services.MaxSiteNameLength {
+		resultStr = resultStr[:services.MaxSiteNameLength]
+	}
+
 	// Remove leading and trailing hyphens
 	resultStr = strings.Trim(resultStr, "-")
 
@@ -156,16 +188,7 @@ func getUserApps(c *fiber.Ctx) error {
 	// Convert to response format
 	appResponses := []fiber.Map{}
 	for _, app := range apps {
-		appResponses = append(appResponses, fiber.Map{
-			"id":             app.Id.Hex(),
-			"name":           app.Name,
-			"sanitizedName":  app.SanitizedName,
-			"description":    app.Description,
-			"isActive":       app.IsActive,
-			"staticFilesURL": app.StaticFilesURL,
-			"createdAt":      app.CreatedAt,
-			"updatedAt":      app.UpdatedAt,
-		})
+		appResponses = append(appResponses, appResponse(app))
 	}
 
 	return utils.SuccessResponseWithData(c, "User apps retrieved", fiber.Map{
@@ -199,47 +222,132 @@ func getAppById(c *fiber.Ctx) error {
 	}
 
 	return utils.SuccessResponseWithData(c, "App retrieved", fiber.Map{
-		"app": fiber.Map{
-			"id":             app.Id.Hex(),
-			"name":           app.Name,
-			"sanitizedName":  app.SanitizedName,
-			"description":    app.Description,
-			"isActive":       app.IsActive,
-			"staticFilesURL": app.StaticFilesURL,
-			"createdAt":      app.CreatedAt,
-			"updatedAt":      app.UpdatedAt,
-		},
+		"app":     appResponse(app),
 		"user_id": userID,
 	})
 }
 
+// appURL is where the edge server serves an app
+func appURL(app model.App) string {
+	return services.AppURL(appConfigEnv.Domain.AppDomain, app.SanitizedName)
+}
+
+// appResponse converts an app to its API representation
+func appResponse(app model.App) fiber.Map {
+	framework := app.Framework
+	if framework == "" {
+		framework = "auto"
+	}
+
+	return fiber.Map{
+		"id":                  app.Id.Hex(),
+		"name":                app.Name,
+		"sanitizedName":       app.SanitizedName,
+		"description":         app.Description,
+		"isActive":            app.IsActive,
+		"url":                 appURL(app),
+		"currentDeploymentId": app.CurrentDeploymentId,
+		"staticFilesURL":      app.StaticFilesURL,
+		"buildTimeouts":       app.BuildTimeouts,
+		"framework":           framework,
+		"flutterVersion":      app.FlutterVersion,
+		"project":             app.Project,
+		"branch":              app.Branch,
+		"autoDeploy":          app.AutoDeploy,
+		"createdAt":           app.CreatedAt,
+		"updatedAt":           app.UpdatedAt,
+	}
+}
+
 func updateApp(c *fiber.Ctx) error {
-	appID := c.Params("id")
 	userID := c.Locals("user_id").(string)
 
-	// TODO: Implement update app logic
-	// - Find app by ID
-	// - Verify user owns the app
-	// - Update app data
-	// - Save to database
+	// Get validated IDs and request from context
+	appObjectID := c.Locals("app_id").(primitive.ObjectID)
+	userObjectID := c.Locals("user_id_obj").(primitive.ObjectID)
+	request := c.Locals("validated_request").(validation.UpdateAppRequest)
+
+	set := bson.M{"updatedAt": time.Now()}
+	if request.Description != nil {
+		set["description"] = *request.Description
+	}
+	if request.BuildTimeouts != nil {
+		set["buildTimeouts"] = model.BuildTimeouts{
+			TotalSeconds:        request.BuildTimeouts.TotalSeconds,
+			CloneSeconds:        request.BuildTimeouts.CloneSeconds,
+			DependenciesSeconds: request.BuildTimeouts.DependenciesSeconds,
+			BuildSeconds:        request.BuildTimeouts.BuildSeconds,
+			UploadSeconds:       request.BuildTimeouts.UploadSeconds,
+		}
+	}
+
+	if request.Framework != nil {
+		framework := *request.Framework
+		if framework == "auto" {
+			framework = ""
+		}
+		set["framework"] = framework
+	}
+	if request.FlutterVersion != nil {
+		set["flutterVersion"] = *request.FlutterVersion
+	}
+	if request.Branch != nil {
+		set["branch"] = *request.Branch
+	}
+	if request.AutoDeploy != nil {
+		set["autoDeploy"] = *request.AutoDeploy
+	}
+
+	// Update the app, verifying ownership in the same query
+	collection := db.Collection("apps")
+	var app model.App
+	err := collection.FindOneAndUpdate(context.Background(), bson.M{
+		"_id":    appObjectID,
+		"userId": userObjectID,
+	}, bson.M{"$set": set}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&app)
+
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return utils.NotFoundResponse(c, "App not found")
+		}
+		logrus.WithError(err).Error("Failed to update app")
+		return utils.InternalServerErrorResponse(c, "Failed to update app")
+	}
 
 	return utils.SuccessResponseWithData(c, "App updated", fiber.Map{
-		"app_id":  appID,
+		"app":     appResponse(app),
 		"user_id": userID,
 	})
 }
 
 func deleteApp(c *fiber.Ctx) error {
-	appID := c.Params("id")
 	userID := c.Locals("user_id").(string)
 
-	// TODO: Implement delete app logic
-	// - Find app by ID
-	// - Verify user owns the app
-	// - Delete app and related data
+	// Get validated IDs from context
+	appObjectID := c.Locals("app_id").(primitive.ObjectID)
+	userObjectID := c.Locals("user_id_obj").(primitive.ObjectID)
+
+	// Delete the app, verifying ownership in the same query
+	var app model.App
+	err := db.Collection("apps").FindOneAndDelete(context.Background(), bson.M{
+		"_id":    appObjectID,
+		"userId": userObjectID,
+	}).Decode(&app)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return utils.NotFoundResponse(c, "App not found")
+		}
+		logrus.WithError(err).Error("Failed to delete app")
+		return utils.InternalServerErrorResponse(c, "Failed to delete app")
+	}
+
+	// The repository's webhook goes with the last app built from it
+	if err := appGitHubService.ReleaseRepository(userID, app.RepositoryId); err != nil {
+		logrus.WithError(err).Warnf("Failed to remove the webhook of repository %s", app.RepositoryId.Hex())
+	}
 
 	return utils.SuccessResponseWithData(c, "App deleted", fiber.Map{
-		"app_id":  appID,
+		"app_id":  app.Id.Hex(),
 		"user_id": userID,
 	})
 }
@@ -251,36 +359,255 @@ func deployApp(c *fiber.Ctx) error {
 	// Get validated request from context
 	request := c.Locals("validated_request").(validation.DeployAppRequest)
 
-	// Start the build process
-	if buildService != nil {
-		buildService.StartBuild(appID, userID, request.RepoURL, request.Branch)
-		logrus.Infof("Started build for app %s, user %s, repo %s", appID, userID, request.RepoURL)
-	} else {
+	if buildService == nil {
 		logrus.Error("Build service not initialized")
 		return utils.InternalServerErrorResponse(c, "Build service not available")
 	}
 
+	appObjectID := c.Locals("app_id").(primitive.ObjectID)
+	var app model.App
+	if err := db.Collection("apps").FindOne(context.Background(), bson.M{"_id": appObjectID}).Decode(&app); err != nil {
+		logrus.WithError(err).Errorf("Failed to fetch app %s", appID)
+		return utils.InternalServerErrorResponse(c, "Failed to fetch app")
+	}
+
+	// An app's repository is the one its webhooks are registered on, so a
+	// deployment from another one would be overwritten by the next push.
+	// Apps linked to none yet, such as those created before linking, are
+	// linked to the repository they are deployed from.
+	if app.RepositoryId.IsZero() {
+		if repository, err := appGitHubService.LinkRepository(userID, request.RepoURL); err != nil {
+			logrus.WithError(err).Warnf("Failed to link repository %s to app %s", request.RepoURL, appID)
+		} else if _, err := db.Collection("apps").UpdateOne(context.Background(), bson.M{"_id": appObjectID}, bson.M{
+			"$set": bson.M{"repositoryId": repository.Id},
+		}); err != nil {
+			logrus.WithError(err).Errorf("Failed to link repository %s to app %s", request.RepoURL, appID)
+		}
+	} else {
+		var repository model.Repository
+		err := db.Collection("repositories").FindOne(context.Background(), bson.M{"_id": app.RepositoryId}).Decode(&repository)
+		if err != nil && err != mongo.ErrNoDocuments {
+			logrus.WithError(err).Errorf("Failed to fetch the repository of app %s", appID)
+			return utils.InternalServerErrorResponse(c, "Failed to fetch app repository")
+		}
+		if err == nil && !services.IsRepositoryURL(request.RepoURL, &repository) {
+			return utils.BadRequestResponse(c, "App is built from "+repository.FullName+"; deploy it from that repository")
+		}
+	}
+
+	// Queue the build for the worker
+	job, err := buildService.EnqueueBuild(appID, userID, request.RepoURL, request.Branch, services.BuildOptions{
+		CommitSha: request.CommitSha,
+		NoCache:   request.NoCache,
+	})
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to queue build for app %s", appID)
+		return utils.InternalServerErrorResponse(c, "Failed to queue deployment")
+	}
+	logrus.Infof("Queued build %s for app %s, user %s, repo %s", job.Id, appID, userID, request.RepoURL)
+
 	return utils.SuccessResponseWithData(c, "App deployment initiated", fiber.Map{
-		"app_id":   appID,
+		"app_id":        appID,
+		"user_id":       userID,
+		"deployment_id": job.DeploymentId.Hex(),
+		"repo_url":      request.RepoURL,
+		"branch":        request.Branch,
+		"commitSha":     request.CommitSha,
+		"noCache":       request.NoCache,
+		"status":        "pending",
+	})
+}
+
+// promoteDeployment makes an earlier successful deployment live again
+// without rebuilding it
+func promoteDeployment(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(string)
+
+	// Get validated IDs from context
+	appObjectID := c.Locals("app_id").(primitive.ObjectID)
+	userObjectID := c.Locals("user_id_obj").(primitive.ObjectID)
+	deploymentObjectID := c.Locals("deployment_id").(primitive.ObjectID)
+
+	promotion, err := buildService.PromoteDeployment(appObjectID, deploymentObjectID, userObjectID)
+	if err != nil {
+		switch err {
+		case mongo.ErrNoDocuments:
+			return utils.NotFoundResponse(c, "Deployment not found")
+		case services.ErrDeploymentNotPromotable:
+			return utils.BadRequestResponse(c, "Only successful deployments with stored artifacts can be promoted")
+		case services.ErrDeploymentLive:
+			return utils.BadRequestResponse(c, "Deployment is already live")
+		}
+		logrus.WithError(err).Errorf("Failed to promote deployment %s", deploymentObjectID.Hex())
+		return utils.InternalServerErrorResponse(c, "Failed to promote deployment")
+	}
+	logrus.Infof("Promoted deployment %s of app %s, user %s", deploymentObjectID.Hex(), appObjectID.Hex(), userID)
+
+	return utils.SuccessResponseWithData(c, "Deployment promoted", fiber.Map{
+		"promotion": promotion,
+		"user_id":   userID,
+	})
+}
+
+// getAppPromotions returns which deployments went live for the app, newest
+// first
+func getAppPromotions(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(string)
+
+	// Get validated IDs from context
+	appObjectID := c.Locals("app_id").(primitive.ObjectID)
+	userObjectID := c.Locals("user_id_obj").(primitive.ObjectID)
+
+	promotions, err := buildService.GetPromotions(appObjectID, userObjectID, 100)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return utils.NotFoundResponse(c, "App not found")
+		}
+		logrus.WithError(err).Error("Failed to fetch promotions")
+		return utils.InternalServerErrorResponse(c, "Failed to fetch promotions")
+	}
+
+	return utils.SuccessResponseWithData(c, "Promotions retrieved", fiber.Map{
+		"promotions": promotions,
+		"count":      len(promotions),
+		"user_id":    userID,
+	})
+}
+
+// getAppPreviews returns the app's pull request previews, newest first
+func getAppPreviews(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(string)
+
+	// Get validated IDs from context
+	appObjectID := c.Locals("app_id").(primitive.ObjectID)
+	userObjectID := c.Locals("user_id_obj").(primitive.ObjectID)
+
+	previews, err := buildService.GetPreviews(appObjectID, userObjectID)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return utils.NotFoundResponse(c, "App not found")
+		}
+		logrus.WithError(err).Error("Failed to fetch previews")
+		return utils.InternalServerErrorResponse(c, "Failed to fetch previews")
+	}
+
+	return utils.SuccessResponseWithData(c, "Previews retrieved", fiber.Map{
+		"previews": previews,
+		"count":    len(previews),
+		"user_id":  userID,
+	})
+}
+
+// getAppWebhookDeliveries returns the webhook deliveries that reached the
+// app, newest first
+func getAppWebhookDeliveries(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(string)
+
+	// Get validated IDs from context
+	appObjectID := c.Locals("app_id").(primitive.ObjectID)
+	userObjectID := c.Locals("user_id_obj").(primitive.ObjectID)
+
+	deliveries, err := buildService.GetWebhookDeliveries(appObjectID, userObjectID, 100)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return utils.NotFoundResponse(c, "App not found")
+		}
+		logrus.WithError(err).Error("Failed to fetch webhook deliveries")
+		return utils.InternalServerErrorResponse(c, "Failed to fetch webhook deliveries")
+	}
+
+	return utils.SuccessResponseWithData(c, "Webhook deliveries retrieved", fiber.Map{
+		"deliveries": deliveries,
+		"count":      len(deliveries),
+		"user_id":    userID,
+	})
+}
+
+// replayWebhookDelivery processes a webhook delivery for the app again
+func replayWebhookDelivery(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(string)
+
+	// Get validated IDs from context
+	appObjectID := c.Locals("app_id").(primitive.ObjectID)
+	userObjectID := c.Locals("user_id_obj").(primitive.ObjectID)
+	deliveryObjectID := c.Locals("delivery_id").(primitive.ObjectID)
+
+	delivery, err := buildService.ReplayWebhookDelivery(appObjectID, deliveryObjectID, userObjectID)
+	if err != nil {
+		switch err {
+		case mongo.ErrNoDocuments:
+			return utils.NotFoundResponse(c, "Delivery not found")
+		case services.ErrDeliveryNotReplayable:
+			return utils.BadRequestResponse(c, "The app is no longer built from the delivery's repository")
+		}
+		logrus.WithError(err).Errorf("Failed to replay webhook delivery %s", deliveryObjectID.Hex())
+		return utils.InternalServerErrorResponse(c, "Failed to replay delivery")
+	}
+
+	return utils.SuccessResponseWithData(c, "Delivery replayed", fiber.Map{
+		"delivery": delivery,
 		"user_id":  userID,
-		"repo_url": request.RepoURL,
-		"branch":   request.Branch,
-		"status":   "pending",
 	})
 }
 
 func getAppStatus(c *fiber.Ctx) error {
-	appID := c.Params("id")
 	userID := c.Locals("user_id").(string)
 
-	// TODO: Implement get app status logic
-	// - Find app by ID
-	// - Verify user owns the app
-	// - Return current deployment status
+	// Get validated IDs from context
+	appObjectID := c.Locals("app_id").(primitive.ObjectID)
+	userObjectID := c.Locals("user_id_obj").(primitive.ObjectID)
+
+	// Find app by ID and verify ownership
+	var app model.App
+	err := db.Collection("apps").FindOne(context.Background(), bson.M{
+		"_id":    appObjectID,
+		"userId": userObjectID,
+	}).Decode(&app)
+
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return utils.NotFoundResponse(c, "App not found")
+		}
+		logrus.WithError(err).Error("Failed to fetch app")
+		return utils.InternalServerErrorResponse(c, "Failed to fetch app")
+	}
+
+	// The latest deployment carries the app's build status. Pull request
+	// previews don't, so a failing preview doesn't show as a failed app.
+	var deployment model.Deployment
+	err = db.Collection("deployments").FindOne(context.Background(),
+		bson.M{"appId": appObjectID, "pullRequest": bson.M{"$exists": false}},
+		options.FindOne().SetSort(bson.M{"createdAt": -1}),
+	).Decode(&deployment)
+
+	if err == mongo.ErrNoDocuments {
+		return utils.SuccessResponseWithData(c, "App status retrieved", fiber.Map{
+			"app_id":  appObjectID.Hex(),
+			"user_id": userID,
+			"status":  "not_deployed",
+		})
+	}
+	if err != nil {
+		logrus.WithError(err).Error("Failed to fetch latest deployment")
+		return utils.InternalServerErrorResponse(c, "Failed to fetch app status")
+	}
+
+	queuePosition := 0
+	if deployment.Status == model.DeploymentStatusPending && buildService != nil {
+		if queuePosition, err = buildService.QueuePosition(deployment.Id); err != nil {
+			logrus.WithError(err).Error("Failed to read queue position")
+		}
+	}
 
 	return utils.SuccessResponseWithData(c, "App status retrieved", fiber.Map{
-		"app_id":  appID,
-		"user_id": userID,
-		"status":  "pending",
+		"app_id":                appObjectID.Hex(),
+		"user_id":               userID,
+		"status":                deployment.Status,
+		"deployment_id":         deployment.Id.Hex(),
+		"queue_position":        queuePosition,
+		"current_deployment_id": app.CurrentDeploymentId,
+		"preview_url":           deployment.PreviewURL,
+		"error":                 deployment.Error,
+		"failure":               deployment.Failure,
 	})
 }
@@ -2,17 +2,32 @@ package controller
 
 import (
 	"breezy/middleware"
+	"breezy/model"
+	"breezy/services"
 	"breezy/utils"
 	"breezy/validation"
+	"context"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func DeploymentController(router fiber.Router) {
+var (
+	deploymentDB           *mongo.Database
+	deploymentBuildService *services.BuildService
+)
+
+func DeploymentController(router fiber.Router, database *mongo.Database, builds *services.BuildService) {
+	deploymentDB = database
+	deploymentBuildService = builds
+
 	router.Get("/", middleware.ValidateAccessToken, validation.ValidateUserIDFromLocals, getUserDeployments)
 	router.Get("/:id", middleware.ValidateAccessToken, validation.ValidateUserIDFromLocals, validation.ValidateDeploymentID, validation.ValidateDeploymentOwnership, getDeploymentById)
 	router.Get("/:id/logs", middleware.ValidateAccessToken, validation.ValidateUserIDFromLocals, validation.ValidateDeploymentID, validation.ValidateDeploymentOwnership, getDeploymentLogs)
+	router.Post("/:id/cancel", middleware.ValidateAccessToken, validation.ValidateUserIDFromLocals, validation.ValidateDeploymentID, validation.ValidateDeploymentOwnership, cancelDeployment)
 }
 
 func getUserDeployments(c *fiber.Ctx) error {
@@ -33,34 +48,152 @@ func getDeploymentById(c *fiber.Ctx) error {
 
 	// Get validated IDs from context
 	deploymentObjectID := c.Locals("deployment_id").(primitive.ObjectID)
-	_ = c.Locals("user_id_obj").(primitive.ObjectID) // Will be used in actual implementation
+	userObjectID := c.Locals("user_id_obj").(primitive.ObjectID)
 
-	// TODO: Implement get deployment by ID logic
-	// - Find deployment by ID
-	// - Verify user owns the deployment
-	// - Return deployment data
+	deployment, err := findUserDeployment(deploymentObjectID, userObjectID)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return utils.NotFoundResponse(c, "Deployment not found")
+		}
+		logrus.WithError(err).Error("Failed to fetch deployment")
+		return utils.InternalServerErrorResponse(c, "Failed to fetch deployment")
+	}
 
 	return utils.SuccessResponseWithData(c, "Deployment retrieved", fiber.Map{
-		"deployment_id": deploymentObjectID.Hex(),
-		"user_id":       userID,
+		"deployment": deploymentResponse(deployment),
+		"user_id":    userID,
 	})
 }
 
+// deploymentResponse is the API representation of a deployment. Build logs
+// are left out; they are served by the logs endpoint.
+func deploymentResponse(deployment *model.Deployment) fiber.Map {
+	response := fiber.Map{
+		"id":             deployment.Id.Hex(),
+		"appId":          deployment.AppId.Hex(),
+		"branch":         deployment.Branch,
+		"gitCommitHash":  deployment.GitCommitHash,
+		"commit":         deploymentCommit(deployment),
+		"status":         deployment.Status,
+		"framework":      deployment.Framework,
+		"logsURL":        deployment.LogsURL,
+		"staticFilesURL": deployment.StaticFilesURL,
+		"previewURL":     deployment.PreviewURL,
+		"error":          deployment.Error,
+		"failure":        deployment.Failure,
+		"project":        deployment.Project,
+		"sdk":            deployment.SDK,
+		"createdAt":      deployment.CreatedAt,
+		"finishedAt":     deployment.FinishedAt,
+	}
+
+	// The pubspec version and Flutter SDK constraint are surfaced directly
+	// as they are what users look for first
+	if deployment.Project != nil {
+		response["version"] = deployment.Project.Version
+		response["flutterConstraint"] = deployment.Project.FlutterConstraint
+	}
+	if deployment.DependencyCache != "" {
+		response["dependencyCache"] = deployment.DependencyCache
+	}
+	if deployment.PullRequest != 0 {
+		response["pullRequest"] = deployment.PullRequest
+	}
+	if deployment.ArtifactPrefix != "" {
+		response["artifacts"] = fiber.Map{
+			"prefix": deployment.ArtifactPrefix,
+			"files":  deployment.ArtifactFiles,
+			"size":   deployment.ArtifactSize,
+		}
+	}
+
+	return response
+}
+
+// deploymentCommit describes the commit a deployment was built from, nil
+// until it has been cloned
+func deploymentCommit(deployment *model.Deployment) fiber.Map {
+	if deployment.GitCommittedAt == nil {
+		return nil
+	}
+	return fiber.Map{
+		"sha":         deployment.GitCommitHash,
+		"subject":     deployment.GitCommitMessage,
+		"author":      deployment.GitCommitAuthor,
+		"authorEmail": deployment.GitCommitAuthorEmail,
+		"committedAt": deployment.GitCommittedAt,
+	}
+}
+
 func getDeploymentLogs(c *fiber.Ctx) error {
 	userID := c.Locals("user_id").(string)
 
 	// Get validated IDs from context
 	deploymentObjectID := c.Locals("deployment_id").(primitive.ObjectID)
-	_ = c.Locals("user_id_obj").(primitive.ObjectID) // Will be used in actual implementation
+	userObjectID := c.Locals("user_id_obj").(primitive.ObjectID)
 
-	// TODO: Implement get deployment logs logic
-	// - Find deployment by ID
-	// - Verify user owns the deployment
-	// - Return build logs
+	deployment, err := findUserDeployment(deploymentObjectID, userObjectID)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return utils.NotFoundResponse(c, "Deployment not found")
+		}
+		logrus.WithError(err).Error("Failed to fetch deployment")
+		return utils.InternalServerErrorResponse(c, "Failed to fetch deployment")
+	}
 
 	return utils.SuccessResponseWithData(c, "Deployment logs retrieved", fiber.Map{
 		"deployment_id": deploymentObjectID.Hex(),
 		"user_id":       userID,
-		"logs":          "",
+		"status":        deployment.Status,
+		"logs":          deployment.BuildLogs,
 	})
 }
+
+func cancelDeployment(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(string)
+
+	// Get validated IDs from context
+	deploymentObjectID := c.Locals("deployment_id").(primitive.ObjectID)
+	userObjectID := c.Locals("user_id_obj").(primitive.ObjectID)
+
+	if err := deploymentBuildService.CancelBuild(deploymentObjectID, userObjectID); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return utils.NotFoundResponse(c, "Deployment not found")
+		}
+		if err == services.ErrBuildNotActive {
+			return utils.BadRequestResponse(c, "Deployment is not queued or building")
+		}
+		logrus.WithError(err).Error("Failed to cancel deployment")
+		return utils.InternalServerErrorResponse(c, "Failed to cancel deployment")
+	}
+
+	return utils.SuccessResponseWithData(c, "Deployment cancelled", fiber.Map{
+		"deployment_id": deploymentObjectID.Hex(),
+		"user_id":       userID,
+		"status":        model.DeploymentStatusCancelled,
+	})
+}
+
+// findUserDeployment loads a deployment and verifies that the app it
+// belongs to is owned by the user. A deployment of someone else's app is
+// reported as not found.
+func findUserDeployment(deploymentID, userID primitive.ObjectID) (*model.Deployment, error) {
+	var deployment model.Deployment
+	err := deploymentDB.Collection("deployments").FindOne(context.Background(), bson.M{"_id": deploymentID}).Decode(&deployment)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := deploymentDB.Collection("apps").CountDocuments(context.Background(), bson.M{
+		"_id":    deployment.AppId,
+		"userId": userID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	return &deployment, nil
+}
@@ -11,20 +11,16 @@ import (
 
 var log = logger.Logger()
 
-func InitializeControllers(app *fiber.App, configEnv *config.Environment, database *mongo.Database) {
-	// Initialize WebSocket service
-	wsService := services.NewWebSocketService()
-	go wsService.Start()
-
-	// Initialize Build service
-	_ = services.NewBuildService(database, configEnv, wsService)
+func InitializeControllers(app *fiber.App, configEnv *config.Environment, database *mongo.Database, wsService *services.WebSocketService, builds *services.BuildService) {
+	// Let clients cancel builds over their WebSocket
+	wsService.SetCancelHandler(builds.CancelBuild)
 
 	// Initialize all controllers
 	AuthController(app.Group("/api/auth"), configEnv, database)
 	UserController(app.Group("/api/users"))
-	AppController(app.Group("/api/apps"), database)
+	AppController(app.Group("/api/apps"), configEnv, database, builds)
 	RepositoryController(app.Group("/api/repositories"), configEnv, database)
-	DeploymentController(app.Group("/api/deployments"))
-	WebhookController(app.Group("/webhooks"))
+	DeploymentController(app.Group("/api/deployments"), database, builds)
+	WebhookController(app.Group("/webhooks"), configEnv, database, builds)
 	WebSocketController(app.Group("/ws"), wsService)
 }
@@ -1,26 +1,50 @@
 package controller
 
 import (
+	"breezy/config"
+	"breezy/model"
+	"breezy/services"
 	"breezy/utils"
 	"breezy/validation"
+	"errors"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func WebhookController(router fiber.Router) {
-	router.Post("/github", validation.ValidateGitHubWebhook, handleGitHubWebhook)
+var webhookBuildService *services.BuildService
+
+func WebhookController(router fiber.Router, env *config.Environment, database *mongo.Database, builds *services.BuildService) {
+	webhookBuildService = builds
+	github := services.NewGitHubService(env, database)
+	router.Post("/github", validation.ValidateGitHubWebhook(github.WebhookSecret), handleGitHubWebhook)
 }
 
 func handleGitHubWebhook(c *fiber.Ctx) error {
-	// Get validated payload from context
-	payload := c.Locals("webhook_payload").(map[string]interface{})
+	deliveryID := c.Get("X-GitHub-Delivery")
+	event := c.Get("X-GitHub-Event")
+	if deliveryID == "" {
+		return utils.BadRequestResponse(c, "X-GitHub-Delivery header is required")
+	}
 
-	// TODO: Implement GitHub webhook handling logic
-	// - Process push events
-	// - Find associated app
-	// - Queue build job
+	delivery, err := webhookBuildService.HandleWebhook(deliveryID, event, c.Body())
+	if errors.Is(err, services.ErrDuplicateDelivery) {
+		logrus.Infof("Ignoring duplicate webhook delivery %s", deliveryID)
+		return utils.SuccessResponseWithData(c, "Duplicate delivery ignored", fiber.Map{
+			"deliveryId": deliveryID,
+		})
+	}
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to record webhook delivery %s", deliveryID)
+		return utils.InternalServerErrorResponse(c, "Failed to record delivery")
+	}
 
-	return utils.SuccessResponseWithData(c, "Webhook received", fiber.Map{
-		"payload": payload,
+	// Failed deliveries show up as such on GitHub
+	if delivery.Status == model.WebhookDeliveryStatusFailed {
+		return utils.InternalServerErrorResponse(c, "Failed to process delivery")
+	}
+	return utils.SuccessResponseWithData(c, delivery.Message, fiber.Map{
+		"delivery": delivery,
 	})
 }
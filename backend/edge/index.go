@@ -0,0 +1,331 @@
+package edge
+
+import (
+	"breezy/config"
+	"breezy/model"
+	"breezy/services"
+	"context"
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// maxCachedSites bounds the site cache. Expired entries are dropped once it
+// is reached, so requests for made up hosts can't grow it forever.
+const maxCachedSites = 10000
+
+// precompressedEncodings are the encodings a build may ship precompressed
+// variants for, as <file>.br and <file>.gz, in order of preference
+var precompressedEncodings = []struct {
+	name      string
+	extension string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// Server serves the deployed apps from the artifact store. An app is served
+// at <sanitizedName>.<AppDomain>, from the files of its current deployment,
+// each of its deployments at <deploymentId>--<sanitizedName>.<AppDomain> and
+// the latest build of each open pull request at
+// pr-<number>--<sanitizedName>.<AppDomain>.
+//
+// It is a plain net/http server rather than a Fiber app: http.ServeContent
+// already handles ranges and conditional requests for any seekable file.
+type Server struct {
+	db     *mongo.Database
+	store  services.ArtifactStore
+	config *config.Environment
+
+	// sites caches which deployment each host serves. Entries live for the
+	// cache TTL, so a promoted deployment is served within that time.
+	mutex sync.Mutex
+	sites map[string]cachedSite
+}
+
+// site is what a host serves
+type site struct {
+	appID        string
+	deploymentID string
+	prefix       string
+}
+
+type cachedSite struct {
+	// site is nil for hosts that serve nothing
+	site    *site
+	expires time.Time
+}
+
+func NewServer(db *mongo.Database, store services.ArtifactStore, config *config.Environment) *Server {
+	return &Server{
+		db:     db,
+		store:  store,
+		config: config,
+		sites:  make(map[string]cachedSite),
+	}
+}
+
+// Start listens on the edge port until the server fails
+func (s *Server) Start() error {
+	server := &http.Server{
+		Addr:              ":" + s.config.Edge.Port,
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	logrus.Infof("Serving apps at *.%s on port %s", s.config.Domain.AppDomain, s.config.Edge.Port)
+	return server.ListenAndServe()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	host, ok := services.ParseSiteHost(s.config.Domain.AppDomain, r.Host)
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	site, err := s.resolve(r.Context(), host)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to resolve site %s", r.Host)
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if site == nil {
+		http.Error(w, "No app is deployed here", http.StatusNotFound)
+		return
+	}
+
+	s.serveFile(w, r, site)
+}
+
+// serveFile serves the requested file of a site. Paths that aren't files
+// fall back to the directory's index.html and then, for routes of single
+// page apps, to the site's index.html.
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, site *site) {
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	candidates := []string{}
+	if name != "" && !strings.HasSuffix(r.URL.Path, "/") {
+		candidates = append(candidates, name)
+	}
+	if path.Ext(name) == "" {
+		candidates = append(candidates, path.Join(name, "index.html"))
+	}
+	if spaFallback(r, name) && name != "" {
+		candidates = append(candidates, "index.html")
+	}
+
+	for _, candidate := range candidates {
+		artifact, encoding, err := s.open(r.Context(), site, candidate, r.Header.Get("Accept-Encoding"))
+		if errors.Is(err, services.ErrArtifactNotFound) {
+			continue
+		}
+		if err != nil {
+			logrus.WithError(err).Errorf("Failed to open %s of deployment %s", candidate, site.deploymentID)
+			http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		defer artifact.Body.Close()
+
+		header := w.Header()
+		header.Set("Content-Type", artifact.ContentType)
+		header.Set("ETag", artifact.ETag)
+		header.Set("Vary", "Accept-Encoding")
+		// Files keep their names across deployments, so they are always
+		// revalidated, which the ETag makes cheap
+		header.Set("Cache-Control", "public, max-age=0, must-revalidate")
+		if encoding != "" {
+			header.Set("Content-Encoding", encoding)
+		}
+
+		http.ServeContent(w, r, "", artifact.ModTime, artifact.Body)
+		return
+	}
+
+	http.Error(w, "Not found", http.StatusNotFound)
+}
+
+// open opens a file of a site, preferring a precompressed variant the
+// client accepts
+func (s *Server) open(ctx context.Context, site *site, name, acceptEncoding string) (*services.Artifact, string, error) {
+	key := site.prefix + "/" + name
+
+	if compressible(services.ContentType(name)) {
+		for _, encoding := range precompressedEncodings {
+			if !acceptsEncoding(acceptEncoding, encoding.name) {
+				continue
+			}
+			artifact, err := s.store.Open(ctx, key+encoding.extension)
+			if err == nil {
+				// The variant is served as the file it encodes
+				artifact.ContentType = services.ContentType(name)
+				return artifact, encoding.name, nil
+			}
+			if !errors.Is(err, services.ErrArtifactNotFound) {
+				return nil, "", err
+			}
+		}
+	}
+
+	artifact, err := s.store.Open(ctx, key)
+	return artifact, "", err
+}
+
+// resolve returns what a host serves, the app's live deployment, the given
+// one or a pull request's, or nil if it serves nothing
+func (s *Server) resolve(ctx context.Context, host *services.SiteHost) (*site, error) {
+	key := host.Name
+	if host.DeploymentID != nil {
+		key = host.DeploymentID.Hex() + "/" + host.Name
+	} else if host.PullRequest != 0 {
+		key = "pr-" + strconv.Itoa(host.PullRequest) + "/" + host.Name
+	}
+
+	s.mutex.Lock()
+	cached, ok := s.sites[key]
+	s.mutex.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.site, nil
+	}
+
+	site, err := s.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	if len(s.sites) >= maxCachedSites {
+		for key, entry := range s.sites {
+			if now.After(entry.expires) {
+				delete(s.sites, key)
+			}
+		}
+	}
+	if len(s.sites) < maxCachedSites {
+		s.sites[key] = cachedSite{site: site, expires: now.Add(s.config.Edge.CacheTTL)}
+	}
+	return site, nil
+}
+
+func (s *Server) lookup(ctx context.Context, host *services.SiteHost) (*site, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var app model.App
+	err := s.db.Collection("apps").FindOne(ctx, bson.M{"sanitizedName": host.Name, "isActive": true}).Decode(&app)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Previews serve any successful deployment of the app, pull requests
+	// their latest successful build and the app's host its live deployment
+	deploymentID := app.CurrentDeploymentId
+	if host.DeploymentID != nil {
+		deploymentID = host.DeploymentID
+	} else if host.PullRequest != 0 {
+		if deploymentID, err = s.pullRequestDeployment(ctx, app.Id, host.PullRequest); err != nil {
+			return nil, err
+		}
+	}
+	if deploymentID == nil {
+		return nil, nil
+	}
+	filter := bson.M{"_id": deploymentID}
+	if host.DeploymentID != nil || host.PullRequest != 0 {
+		filter["appId"] = app.Id
+		filter["status"] = model.DeploymentStatusSuccess
+	}
+
+	var deployment model.Deployment
+	err = s.db.Collection("deployments").FindOne(ctx, filter).Decode(&deployment)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Deployments from before the artifact store have no files to serve
+	if deployment.ArtifactPrefix == "" {
+		return nil, nil
+	}
+
+	return &site{
+		appID:        app.Id.Hex(),
+		deploymentID: deployment.Id.Hex(),
+		prefix:       deployment.ArtifactPrefix,
+	}, nil
+}
+
+// pullRequestDeployment returns the deployment an open pull request's
+// preview serves, nil if it has none
+func (s *Server) pullRequestDeployment(ctx context.Context, appID primitive.ObjectID, number int) (*primitive.ObjectID, error) {
+	var preview model.PullRequestPreview
+	err := s.db.Collection("previews").FindOne(ctx, bson.M{
+		"appId":  appID,
+		"number": number,
+		"state":  model.PreviewStateOpen,
+	}).Decode(&preview)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return preview.DeploymentId, nil
+}
+
+// spaFallback reports whether a missing file is a route of a single page
+// app, which is served its index.html. Missing assets still get a 404.
+func spaFallback(r *http.Request, name string) bool {
+	return path.Ext(name) == "" || strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// compressible reports whether files of a content type are worth shipping
+// precompressed
+func compressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	switch mediaType {
+	case "application/javascript", "application/json", "application/manifest+json",
+		"application/wasm", "application/xml", "image/svg+xml", "font/ttf", "font/otf":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "text/")
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows an
+// encoding
+func acceptsEncoding(header, encoding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), encoding) {
+			continue
+		}
+		quality, hasQuality := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !hasQuality {
+			return true
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(quality), 64)
+		return err == nil && q > 0
+	}
+	return false
+}
@@ -4,7 +4,7 @@ import (
 	"context"
 	"time"
 
-	// "github.com/go-redis/redis/v8"
+	"github.com/go-redis/redis/v8"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/recover"
@@ -12,12 +12,14 @@ import (
 
 	"breezy/config"
 	"breezy/controller"
+	"breezy/edge"
 	"breezy/logger"
 	"breezy/middleware"
 	"breezy/repository"
+	"breezy/services"
 	"breezy/utils"
 	"breezy/validation"
-	// "breezy/worker"
+	"breezy/worker"
 )
 
 var log = logger.Logger()
@@ -55,24 +57,64 @@ func main() {
 	repository.InitializeRepositories(db)
 
 	// Initialize Redis connection
-	// redisClient := redis.NewClient(&redis.Options{
-	// 	Addr:     env.Redis.Addr,
-	// 	Password: env.Redis.Password,
-	// 	DB:       env.Redis.DB,
-	// })
-	// defer redisClient.Close()
+	redisClient := redis.NewClient(&redis.Options{
+		Addr:     env.Redis.Addr,
+		Password: env.Redis.Password,
+		DB:       env.Redis.DB,
+	})
+	defer redisClient.Close()
 
 	// Test Redis connection
-	// ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	// defer cancel()
-	// if err := redisClient.Ping(ctx).Err(); err != nil {
-	// 	log.Fatalf("Failed to connect to Redis: %v", err)
-	// }
-	// log.Info("Connected to Redis successfully")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := redisClient.Ping(ctx).Err(); err != nil {
+		log.Fatalf("Failed to connect to Redis: %v", err)
+	}
+	log.Info("Connected to Redis successfully")
+
+	// Load the GitHub App repositories are accessed as, if one is configured
+	githubApp, err := services.LoadGitHubApp(env)
+	if err != nil {
+		log.Fatalf("Failed to load GitHub App: %v", err)
+	}
+	if githubApp != nil {
+		log.Infof("Accessing repositories as GitHub App %d where it is installed", githubApp.ID())
+	}
 
-	// // Initialize build worker
-	// buildWorker := worker.NewWorker(db, redisClient, env)
-	// go buildWorker.Start()
+	// Initialize WebSocket and Build services
+	wsService := services.NewWebSocketService(redisClient)
+	go wsService.Start()
+	buildQueue := services.NewBuildQueue(redisClient, env.Build)
+	buildExecutor, err := services.NewBuildExecutor(env)
+	if err != nil {
+		log.Fatalf("Failed to initialize build executor: %v", err)
+	}
+	if env.Build.Executor == services.BuildExecutorHost {
+		log.Warn("Builds run directly on this host; use the docker executor outside development")
+	}
+	artifactStore, err := services.NewArtifactStore(env)
+	if err != nil {
+		log.Fatalf("Failed to initialize artifact store: %v", err)
+	}
+	buildService := services.NewBuildService(db, env, wsService, buildQueue, buildExecutor, artifactStore)
+
+	// Initialize build worker. With Prefork only the parent process runs it,
+	// so a build never depends on which child handled the deploy request.
+	if !fiber.IsChild() {
+		buildWorker := worker.NewWorker(db, buildQueue, buildService, env)
+		go buildWorker.Start()
+	}
+
+	// The edge server serves the deployed apps on a port of its own. Like
+	// the worker it runs in the parent process only.
+	if !fiber.IsChild() && env.Edge.Port != "" {
+		edgeServer := edge.NewServer(db, artifactStore, env)
+		go func() {
+			if err := edgeServer.Start(); err != nil {
+				log.Fatalf("Failed to start edge server: %v", err)
+			}
+		}()
+	}
 
 	// Initialize Fiber app
 	app := fiber.New(fiber.Config{
@@ -93,7 +135,7 @@ func main() {
 	app.Use(middleware.DisplayRequest)
 
 	// Initialize controllers
-	controller.InitializeControllers(app, env, db)
+	controller.InitializeControllers(app, env, db, wsService, buildService)
 
 	// Health check endpoint
 	app.Get("/health", func(c *fiber.Ctx) error {
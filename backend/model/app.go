@@ -1,6 +1,8 @@
 package model
 
 import (
+	"regexp"
+	"slices"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -17,6 +19,44 @@ type App struct {
 	CustomDomainId      *primitive.ObjectID `bson:"customDomainId,omitempty" json:"customDomainId"`
 	StaticFilesURL      string              `bson:"staticFilesURL,omitempty" json:"staticFilesURL"`
 	IsActive            bool                `bson:"isActive" json:"isActive"`
+	BuildTimeouts       *BuildTimeouts      `bson:"buildTimeouts,omitempty" json:"buildTimeouts"`
+	Framework           string              `bson:"framework,omitempty" json:"framework"`
+	FlutterVersion      string              `bson:"flutterVersion,omitempty" json:"flutterVersion"`
+	Project             *ProjectMetadata    `bson:"project,omitempty" json:"project"`
+	Branch              string              `bson:"branch,omitempty" json:"branch"`
+	AutoDeploy          bool                `bson:"autoDeploy" json:"autoDeploy"`
 	CreatedAt           time.Time           `bson:"createdAt" json:"createdAt"`
 	UpdatedAt           time.Time           `bson:"updatedAt" json:"updatedAt"`
 }
+
+// Frameworks an app can be built with. An app without one has its
+// framework detected from the repository on every build.
+const (
+	FrameworkFlutter = "flutter"
+	FrameworkStatic  = "static"
+	FrameworkNode    = "node"
+	FrameworkHugo    = "hugo"
+)
+
+// FlutterChannels are the Flutter channels an app can pin instead of a
+// release
+var FlutterChannels = []string{"stable", "beta", "master", "main"}
+
+// FlutterVersionPattern matches a Flutter release such as 3.24.3 or
+// 3.26.0-0.1.pre. The API and breezy.yaml accept the same releases.
+var FlutterVersionPattern = regexp.MustCompile(`^\d+\.\d+\.\d+([-+.][0-9A-Za-z.-]+)?$`)
+
+// IsFlutterVersion reports whether version is a Flutter release or channel
+func IsFlutterVersion(version string) bool {
+	return slices.Contains(FlutterChannels, version) || FlutterVersionPattern.MatchString(version)
+}
+
+// BuildTimeouts overrides the server's build time limits for an app. A zero
+// value keeps the server default.
+type BuildTimeouts struct {
+	TotalSeconds        int `bson:"totalSeconds,omitempty" json:"totalSeconds,omitempty"`
+	CloneSeconds        int `bson:"cloneSeconds,omitempty" json:"cloneSeconds,omitempty"`
+	DependenciesSeconds int `bson:"dependenciesSeconds,omitempty" json:"dependenciesSeconds,omitempty"`
+	BuildSeconds        int `bson:"buildSeconds,omitempty" json:"buildSeconds,omitempty"`
+	UploadSeconds       int `bson:"uploadSeconds,omitempty" json:"uploadSeconds,omitempty"`
+}
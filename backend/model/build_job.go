@@ -15,9 +15,18 @@ type BuildJob struct {
 	CommitHash   string             `json:"commitHash"`
 	Branch       string             `json:"branch"`
 	DeploymentId primitive.ObjectID `json:"deploymentId"`
-	CreatedAt    time.Time          `json:"createdAt"`
+	// NoCache clears the app's dependency cache before building
+	NoCache bool `json:"noCache,omitempty"`
+	// CommitMessage is the message of the commit being built when it is
+	// known up front, as for pushes
+	CommitMessage string `json:"commitMessage,omitempty"`
+	// PullRequest is the pull request a preview is built for, 0 for builds
+	// that go live
+	PullRequest int       `json:"pullRequest,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
 }
 
+// GitHubWebhookPayload is the payload of a push webhook
 type GitHubWebhookPayload struct {
 	Ref        string `json:"ref"`
 	Before     string `json:"before"`
@@ -26,6 +35,7 @@ type GitHubWebhookPayload struct {
 		Id       int64  `json:"id"`
 		Name     string `json:"name"`
 		FullName string `json:"full_name"`
+		CloneURL string `json:"clone_url"`
 		Private  bool   `json:"private"`
 		Owner    struct {
 			Login string `json:"login"`
@@ -39,4 +49,33 @@ type GitHubWebhookPayload struct {
 		Id      string `json:"id"`
 		Message string `json:"message"`
 	} `json:"head_commit"`
+	// Deleted is set for pushes that delete the ref
+	Deleted bool `json:"deleted"`
+}
+
+// GitHubPullRequestEvent is the payload of a pull_request webhook
+type GitHubPullRequestEvent struct {
+	Action      string `json:"action"`
+	Number      int    `json:"number"`
+	PullRequest struct {
+		Title   string `json:"title"`
+		HTMLURL string `json:"html_url"`
+		Merged  bool   `json:"merged"`
+		Head    struct {
+			Ref string `json:"ref"`
+			Sha string `json:"sha"`
+			// Repo is nil when the fork the pull request is from was deleted
+			Repo *GitHubWebhookRepository `json:"repo"`
+		} `json:"head"`
+	} `json:"pull_request"`
+	Repository GitHubWebhookRepository `json:"repository"`
+}
+
+// GitHubWebhookRepository is a repository as described in webhook payloads
+type GitHubWebhookRepository struct {
+	Id       int64  `json:"id"`
+	Name     string `json:"name"`
+	FullName string `json:"full_name"`
+	CloneURL string `json:"clone_url"`
+	Private  bool   `json:"private"`
 }
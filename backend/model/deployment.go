@@ -7,25 +7,86 @@ import (
 )
 
 type Deployment struct {
-	Id               primitive.ObjectID `bson:"_id" json:"id"`
-	AppId            primitive.ObjectID `bson:"appId" json:"appId"`
-	GitCommitHash    string             `bson:"gitCommitHash" json:"gitCommitHash"`
-	GitCommitMessage string             `bson:"gitCommitMessage" json:"gitCommitMessage"`
-	Branch           string             `bson:"branch" json:"branch"`
-	Status           DeploymentStatus   `bson:"status" json:"status"`
-	LogsURL          string             `bson:"logsURL,omitempty" json:"logsURL"`
-	StaticFilesURL   string             `bson:"staticFilesURL,omitempty" json:"staticFilesURL"`
-	BuildLogs        string             `bson:"buildLogs,omitempty" json:"buildLogs"`
-	Error            string             `bson:"error,omitempty" json:"error"`
-	CreatedAt        time.Time          `bson:"createdAt" json:"createdAt"`
-	FinishedAt       *time.Time         `bson:"finishedAt,omitempty" json:"finishedAt"`
+	Id                   primitive.ObjectID `bson:"_id" json:"id"`
+	AppId                primitive.ObjectID `bson:"appId" json:"appId"`
+	GitCommitHash        string             `bson:"gitCommitHash" json:"gitCommitHash"`
+	GitCommitMessage     string             `bson:"gitCommitMessage" json:"gitCommitMessage"`
+	GitCommitAuthor      string             `bson:"gitCommitAuthor,omitempty" json:"gitCommitAuthor,omitempty"`
+	GitCommitAuthorEmail string             `bson:"gitCommitAuthorEmail,omitempty" json:"gitCommitAuthorEmail,omitempty"`
+	GitCommittedAt       *time.Time         `bson:"gitCommittedAt,omitempty" json:"gitCommittedAt,omitempty"`
+	Branch               string             `bson:"branch" json:"branch"`
+	Framework            string             `bson:"framework,omitempty" json:"framework,omitempty"`
+	Status               DeploymentStatus   `bson:"status" json:"status"`
+	LogsURL              string             `bson:"logsURL,omitempty" json:"logsURL"`
+	StaticFilesURL       string             `bson:"staticFilesURL,omitempty" json:"staticFilesURL"`
+	PreviewURL           string             `bson:"previewURL,omitempty" json:"previewURL,omitempty"`
+	BuildLogs            string             `bson:"buildLogs,omitempty" json:"buildLogs"`
+	Error                string             `bson:"error,omitempty" json:"error"`
+	Failure              *DeploymentFailure `bson:"failure,omitempty" json:"failure,omitempty"`
+	Project              *ProjectMetadata   `bson:"project,omitempty" json:"project,omitempty"`
+	SDK                  *SDKVersion        `bson:"sdk,omitempty" json:"sdk,omitempty"`
+	// DependencyCache is hit, miss or cleared when the build used the
+	// dependency cache
+	DependencyCache string `bson:"dependencyCache,omitempty" json:"dependencyCache,omitempty"`
+	// PullRequest is the pull request the deployment previews, 0 for
+	// deployments of the app itself
+	PullRequest int `bson:"pullRequest,omitempty" json:"pullRequest,omitempty"`
+	// ArtifactPrefix is where the deployment's files are kept in the
+	// artifact store
+	ArtifactPrefix string     `bson:"artifactPrefix,omitempty" json:"artifactPrefix,omitempty"`
+	ArtifactFiles  int        `bson:"artifactFiles,omitempty" json:"artifactFiles,omitempty"`
+	ArtifactSize   int64      `bson:"artifactSize,omitempty" json:"artifactSize,omitempty"`
+	CreatedAt      time.Time  `bson:"createdAt" json:"createdAt"`
+	FinishedAt     *time.Time `bson:"finishedAt,omitempty" json:"finishedAt"`
 }
 
 type DeploymentStatus string
 
 const (
-	DeploymentStatusPending  DeploymentStatus = "pending"
-	DeploymentStatusBuilding DeploymentStatus = "building"
-	DeploymentStatusSuccess  DeploymentStatus = "success"
-	DeploymentStatusFailed   DeploymentStatus = "failed"
+	DeploymentStatusPending    DeploymentStatus = "pending"
+	DeploymentStatusBuilding   DeploymentStatus = "building"
+	DeploymentStatusSuccess    DeploymentStatus = "success"
+	DeploymentStatusFailed     DeploymentStatus = "failed"
+	DeploymentStatusCancelled  DeploymentStatus = "cancelled"
+	DeploymentStatusSuperseded DeploymentStatus = "superseded"
+)
+
+// SDKVersion is the SDK a deployment was built with, as reported by
+// `flutter --version`
+type SDKVersion struct {
+	Name           string `bson:"name" json:"name"`
+	Version        string `bson:"version" json:"version"`
+	Channel        string `bson:"channel,omitempty" json:"channel,omitempty"`
+	Revision       string `bson:"revision,omitempty" json:"revision,omitempty"`
+	EngineRevision string `bson:"engineRevision,omitempty" json:"engineRevision,omitempty"`
+	DartVersion    string `bson:"dartVersion,omitempty" json:"dartVersion,omitempty"`
+	// Requested is the version or channel asked for, empty for the default
+	Requested string `bson:"requested,omitempty" json:"requested,omitempty"`
+	// Source is where the SDK was chosen from: the app settings,
+	// breezy.yaml, .fvmrc, pubspec.yaml or default
+	Source string `bson:"source" json:"source"`
+}
+
+// DeploymentFailure describes why a deployment failed
+type DeploymentFailure struct {
+	Reason         FailureReason `bson:"reason" json:"reason"`
+	Step           string        `bson:"step,omitempty" json:"step,omitempty"`
+	Message        string        `bson:"message" json:"message"`
+	TimeoutSeconds int64         `bson:"timeoutSeconds,omitempty" json:"timeoutSeconds,omitempty"`
+}
+
+type FailureReason string
+
+const (
+	FailureReasonError   FailureReason = "error"
+	FailureReasonTimeout FailureReason = "timeout"
+	// FailureReasonConfig means the repository's build configuration is
+	// invalid
+	FailureReasonConfig FailureReason = "config"
+	// FailureReasonSDK means the requested SDK isn't installed or doesn't
+	// satisfy the project's constraints
+	FailureReasonSDK FailureReason = "sdk"
+	// FailureReasonAccess means the repository couldn't be cloned with the
+	// app owner's credentials
+	FailureReasonAccess FailureReason = "access"
 )
@@ -0,0 +1,38 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PullRequestPreview is the preview of an app for an open pull request,
+// served at a URL that stays the same as the pull request is updated
+type PullRequestPreview struct {
+	Id      primitive.ObjectID `bson:"_id" json:"id"`
+	AppId   primitive.ObjectID `bson:"appId" json:"appId"`
+	Number  int                `bson:"number" json:"number"`
+	Title   string             `bson:"title" json:"title"`
+	HTMLURL string             `bson:"htmlURL" json:"htmlURL"`
+	HeadRef string             `bson:"headRef" json:"headRef"`
+	HeadSha string             `bson:"headSha" json:"headSha"`
+	State   PreviewState       `bson:"state" json:"state"`
+	URL     string             `bson:"url" json:"url"`
+	// DeploymentId is the deployment served at the preview URL, nil until
+	// a build of the pull request succeeds
+	DeploymentId *primitive.ObjectID `bson:"deploymentId,omitempty" json:"deploymentId"`
+	// CommentId is the pull request comment the preview is reported in
+	CommentId int64      `bson:"commentId,omitempty" json:"commentId,omitempty"`
+	CreatedAt time.Time  `bson:"createdAt" json:"createdAt"`
+	UpdatedAt time.Time  `bson:"updatedAt" json:"updatedAt"`
+	ClosedAt  *time.Time `bson:"closedAt,omitempty" json:"closedAt,omitempty"`
+}
+
+type PreviewState string
+
+const (
+	PreviewStateOpen PreviewState = "open"
+	// PreviewStateClosed means the pull request was closed and the
+	// preview's files were removed
+	PreviewStateClosed PreviewState = "closed"
+)
@@ -0,0 +1,26 @@
+package model
+
+// ProjectMetadata describes a built project, as read from its pubspec.yaml
+// or package.json
+type ProjectMetadata struct {
+	Name        string `bson:"name,omitempty" json:"name,omitempty"`
+	Description string `bson:"description,omitempty" json:"description,omitempty"`
+	Version     string `bson:"version,omitempty" json:"version,omitempty"`
+	// SDKConstraint and FlutterConstraint are the Dart and Flutter SDK
+	// versions a Flutter project declares it supports
+	SDKConstraint     string              `bson:"sdkConstraint,omitempty" json:"sdkConstraint,omitempty"`
+	FlutterConstraint string              `bson:"flutterConstraint,omitempty" json:"flutterConstraint,omitempty"`
+	Dependencies      []ProjectDependency `bson:"dependencies,omitempty" json:"dependencies,omitempty"`
+}
+
+// ProjectDependency is a package the project depends on
+type ProjectDependency struct {
+	Name string `bson:"name" json:"name"`
+	// Constraint is the version constraint, if the package comes from a
+	// package repository
+	Constraint string `bson:"constraint,omitempty" json:"constraint,omitempty"`
+	// Source is where the package comes from: hosted, sdk, git or path for
+	// Dart packages, npm for Node packages
+	Source string `bson:"source" json:"source"`
+	Dev    bool   `bson:"dev,omitempty" json:"dev,omitempty"`
+}
@@ -0,0 +1,31 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Promotion records a deployment going live for an app
+type Promotion struct {
+	Id           primitive.ObjectID `bson:"_id" json:"id"`
+	AppId        primitive.ObjectID `bson:"appId" json:"appId"`
+	DeploymentId primitive.ObjectID `bson:"deploymentId" json:"deploymentId"`
+	// PreviousDeploymentId is the deployment that was live before, nil for
+	// an app's first deployment
+	PreviousDeploymentId *primitive.ObjectID `bson:"previousDeploymentId,omitempty" json:"previousDeploymentId"`
+	Trigger              PromotionTrigger    `bson:"trigger" json:"trigger"`
+	// UserId is who promoted the deployment by hand, nil for builds
+	UserId    *primitive.ObjectID `bson:"userId,omitempty" json:"userId"`
+	CreatedAt time.Time           `bson:"createdAt" json:"createdAt"`
+}
+
+type PromotionTrigger string
+
+const (
+	// PromotionTriggerBuild means a successful build went live
+	PromotionTriggerBuild PromotionTrigger = "build"
+	// PromotionTriggerManual means a user promoted an earlier deployment,
+	// such as to roll back
+	PromotionTriggerManual PromotionTrigger = "manual"
+)
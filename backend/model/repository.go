@@ -17,4 +17,13 @@ type Repository struct {
 	CloneURL      string             `bson:"cloneURL" json:"cloneURL"`
 	Private       bool               `bson:"private" json:"private"`
 	CreatedAt     time.Time          `bson:"createdAt" json:"createdAt"`
+	// WebhookId is the webhook registered on the repository, 0 if there is
+	// none
+	WebhookId int64 `bson:"webhookId,omitempty" json:"webhookId,omitempty"`
+	// WebhookSecret signs the webhook's deliveries, encrypted with the
+	// server's encryption key
+	WebhookSecret string `bson:"webhookSecret,omitempty" json:"-"`
+	// InstallationId is the installation of the GitHub App the repository
+	// is accessed through, 0 if the app isn't installed on it
+	InstallationId int64 `bson:"installationId,omitempty" json:"installationId,omitempty"`
 }
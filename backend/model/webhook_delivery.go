@@ -0,0 +1,60 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// WebhookDelivery records a webhook delivery from GitHub and what came of
+// it, so that a push that didn't deploy can be traced
+type WebhookDelivery struct {
+	Id primitive.ObjectID `bson:"_id" json:"id"`
+	// DeliveryId is GitHub's X-GitHub-Delivery ID. Replays get the ID of
+	// the delivery they replay with a suffix of their own.
+	DeliveryId   string `bson:"deliveryId" json:"deliveryId"`
+	Event        string `bson:"event" json:"event"`
+	Action       string `bson:"action,omitempty" json:"action,omitempty"`
+	GitHubRepoId int64  `bson:"githubRepoId" json:"githubRepoId"`
+	Repository   string `bson:"repository" json:"repository"`
+	Ref          string `bson:"ref,omitempty" json:"ref,omitempty"`
+	CommitSha    string `bson:"commitSha,omitempty" json:"commitSha,omitempty"`
+	// ReplayOf is the delivery this one replays, nil for deliveries from
+	// GitHub
+	ReplayOf *primitive.ObjectID   `bson:"replayOf,omitempty" json:"replayOf,omitempty"`
+	Status   WebhookDeliveryStatus `bson:"status" json:"status"`
+	// Message sums up the outcome, or says why the delivery failed
+	Message string `bson:"message,omitempty" json:"message,omitempty"`
+	// Results are what the delivery did for each app built from the
+	// repository
+	Results []WebhookDeliveryResult `bson:"results" json:"results"`
+	// Payload is the delivery's body, kept to replay it
+	Payload     string     `bson:"payload" json:"-"`
+	ReceivedAt  time.Time  `bson:"receivedAt" json:"receivedAt"`
+	ProcessedAt *time.Time `bson:"processedAt,omitempty" json:"processedAt,omitempty"`
+}
+
+// WebhookDeliveryResult is what a delivery did for an app
+type WebhookDeliveryResult struct {
+	AppId primitive.ObjectID `bson:"appId" json:"appId"`
+	// DeploymentId is the build the delivery queued, nil if it queued none
+	DeploymentId *primitive.ObjectID `bson:"deploymentId,omitempty" json:"deploymentId,omitempty"`
+	Message      string              `bson:"message" json:"message"`
+}
+
+type WebhookDeliveryStatus string
+
+const (
+	// WebhookDeliveryStatusReceived means the delivery is being processed,
+	// or the server stopped before it was
+	WebhookDeliveryStatusReceived WebhookDeliveryStatus = "received"
+	// WebhookDeliveryStatusProcessed means every app built from the
+	// repository handled the delivery, see the results
+	WebhookDeliveryStatusProcessed WebhookDeliveryStatus = "processed"
+	// WebhookDeliveryStatusIgnored means the delivery's event isn't handled
+	// or no app is built from its repository
+	WebhookDeliveryStatusIgnored WebhookDeliveryStatus = "ignored"
+	// WebhookDeliveryStatusFailed means processing the delivery failed for
+	// some app, see the message and results
+	WebhookDeliveryStatusFailed WebhookDeliveryStatus = "failed"
+)
@@ -22,6 +22,9 @@ func InitializeRepositories(db *mongo.Database) {
 	repositories["repositories"] = &Repository{Collection: db.Collection("repositories")}
 	repositories["deployments"] = &Repository{Collection: db.Collection("deployments")}
 	repositories["custom_domains"] = &Repository{Collection: db.Collection("custom_domains")}
+	repositories["promotions"] = &Repository{Collection: db.Collection("promotions")}
+	repositories["previews"] = &Repository{Collection: db.Collection("previews")}
+	repositories["webhook_deliveries"] = &Repository{Collection: db.Collection("webhook_deliveries")}
 
 	// Create indexes
 	createIndexes()
@@ -46,6 +49,8 @@ func createIndexes() {
 		createIndex(appRepo.Collection, "sanitizedName", true)
 		// Create userId index for apps
 		createIndex(appRepo.Collection, "userId", false)
+		// Create repositoryId index for apps
+		createIndex(appRepo.Collection, "repositoryId", false)
 	}
 
 	// Repository indexes
@@ -74,6 +79,32 @@ func createIndexes() {
 		// Create appId index for custom_domains
 		createIndex(domainRepo.Collection, "appId", false)
 	}
+
+	// Promotion indexes
+	promotionRepo := repositories["promotions"]
+	if promotionRepo != nil {
+		// Create appId index for promotions
+		createIndex(promotionRepo.Collection, "appId", false)
+	}
+
+	// Preview indexes
+	previewRepo := repositories["previews"]
+	if previewRepo != nil {
+		// Create appId index for previews
+		createIndex(previewRepo.Collection, "appId", false)
+	}
+
+	// Webhook delivery indexes
+	deliveryRepo := repositories["webhook_deliveries"]
+	if deliveryRepo != nil {
+		// Create deliveryId index for webhook_deliveries, which makes
+		// redeliveries duplicates
+		createIndex(deliveryRepo.Collection, "deliveryId", true)
+		// Create results.appId index for webhook_deliveries
+		createIndex(deliveryRepo.Collection, "results.appId", false)
+		// Create githubRepoId index for webhook_deliveries
+		createIndex(deliveryRepo.Collection, "githubRepoId", false)
+	}
 }
 
 func createIndex(collection *mongo.Collection, field string, unique bool) {
@@ -0,0 +1,247 @@
+package services
+
+import (
+	"breezy/config"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ArtifactStoreLocal = "local"
+	ArtifactStoreS3    = "s3"
+)
+
+// ErrArtifactNotFound is returned when no file is stored under a key
+var ErrArtifactNotFound = errors.New("artifact not found")
+
+// artifactUploadWorkers is how many files of a deployment are uploaded at
+// once
+const artifactUploadWorkers = 8
+
+// contentTypes are the types of common web files. Go's mime table depends
+// on the system's, which often lacks or gets these wrong.
+var contentTypes = map[string]string{
+	".html":        "text/html; charset=utf-8",
+	".htm":         "text/html; charset=utf-8",
+	".css":         "text/css; charset=utf-8",
+	".js":          "text/javascript; charset=utf-8",
+	".mjs":         "text/javascript; charset=utf-8",
+	".json":        "application/json",
+	".map":         "application/json",
+	".webmanifest": "application/manifest+json",
+	".wasm":        "application/wasm",
+	".txt":         "text/plain; charset=utf-8",
+	".xml":         "application/xml",
+	".svg":         "image/svg+xml",
+	".png":         "image/png",
+	".jpg":         "image/jpeg",
+	".jpeg":        "image/jpeg",
+	".gif":         "image/gif",
+	".webp":        "image/webp",
+	".avif":        "image/avif",
+	".ico":         "image/x-icon",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+	".ttf":         "font/ttf",
+	".otf":         "font/otf",
+	".mp4":         "video/mp4",
+	".webm":        "video/webm",
+	".mp3":         "audio/mpeg",
+	".pdf":         "application/pdf",
+}
+
+// ArtifactStore stores the files of deployments. Every deployment is
+// written under a prefix of its own that is never written again, so a
+// deployment's files stay as they were built.
+type ArtifactStore interface {
+	// Put stores a file. Keys are slash separated.
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	// Open returns the file stored under key, or ErrArtifactNotFound
+	Open(ctx context.Context, key string) (*Artifact, error)
+	// DeletePrefix removes every file stored under a prefix
+	DeletePrefix(ctx context.Context, prefix string) error
+	// URL returns where the file or prefix stored under key can be fetched
+	URL(key string) string
+}
+
+// Artifact is a stored file opened for reading. Body can seek, so parts of
+// the file can be read without reading all of it.
+type Artifact struct {
+	Body        io.ReadSeekCloser
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+	// ETag identifies the file's content, quoted as sent in HTTP headers
+	ETag string
+}
+
+// NewArtifactStore returns the store selected by the artifact config
+func NewArtifactStore(env *config.Environment) (ArtifactStore, error) {
+	switch env.Artifacts.Store {
+	case ArtifactStoreLocal, "":
+		return NewLocalArtifactStore(env.Artifacts.LocalDir, env.Artifacts.BaseURL)
+	case ArtifactStoreS3:
+		return NewS3ArtifactStore(env.Artifacts.S3, env.Artifacts.BaseURL, env.Cloudflare)
+	default:
+		return nil, fmt.Errorf("unknown artifact store %q", env.Artifacts.Store)
+	}
+}
+
+// deploymentArtifactPrefix is where a deployment's files are stored
+func deploymentArtifactPrefix(appID, deploymentID string) string {
+	return path.Join("apps", appID, "deployments", deploymentID)
+}
+
+// ContentType returns the Content-Type a file is served with
+func ContentType(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if contentType, ok := contentTypes[ext]; ok {
+		return contentType
+	}
+	if contentType := mime.TypeByExtension(ext); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// artifactFile is a file of the build output to upload
+type artifactFile struct {
+	// path is where the file is read from on the host
+	path string
+	// name is the slash separated path within the output
+	name string
+	size int64
+}
+
+// artifactUpload summarizes an uploaded build output
+type artifactUpload struct {
+	Prefix string
+	URL    string
+	Files  int
+	Size   int64
+}
+
+// uploadArtifacts uploads the build output in dir under prefix. Git
+// metadata is left out, as are symlinks that lead outside dir, which the
+// build controls.
+func uploadArtifacts(ctx context.Context, store ArtifactStore, dir, prefix string, output io.Writer) (*artifactUpload, error) {
+	files, err := collectArtifacts(dir, output)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("the build output is empty")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mutex    sync.Mutex
+		firstErr error
+	)
+	queue := make(chan artifactFile)
+	for i := 0; i < artifactUploadWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range queue {
+				if err := putArtifact(ctx, store, prefix, file); err != nil {
+					mutex.Lock()
+					if firstErr == nil {
+						firstErr = fmt.Errorf("failed to upload %s: %v", file.name, err)
+						cancel()
+					}
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+
+	upload := &artifactUpload{Prefix: prefix, URL: store.URL(prefix) + "/"}
+	for _, file := range files {
+		select {
+		case queue <- file:
+			upload.Files++
+			upload.Size += file.size
+		case <-ctx.Done():
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func putArtifact(ctx context.Context, store ArtifactStore, prefix string, file artifactFile) error {
+	f, err := os.Open(file.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return store.Put(ctx, path.Join(prefix, file.name), f, file.size, ContentType(file.name))
+}
+
+// collectArtifacts lists the files to upload from dir
+func collectArtifacts(dir string, output io.Writer) ([]artifactFile, error) {
+	files := []artifactFile{}
+	err := filepath.WalkDir(dir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+
+		switch {
+		case d.IsDir():
+			// A static site's output is the repository itself
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := resolveWithin(dir, rel)
+			if err != nil {
+				fmt.Fprintf(output, "Skipping %s: %v\n", name, err)
+				return nil
+			}
+			info, err := os.Stat(target)
+			if err != nil || !info.Mode().IsRegular() {
+				// Linked directories aren't followed, so links can't loop
+				fmt.Fprintf(output, "Skipping %s: only links to files are uploaded\n", name)
+				return nil
+			}
+			files = append(files, artifactFile{path: target, name: name, size: info.Size()})
+		case d.Type().IsRegular():
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			files = append(files, artifactFile{path: filePath, name: name, size: info.Size()})
+		}
+		return nil
+	})
+	return files, err
+}
@@ -0,0 +1,138 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// LocalArtifactStore keeps deployments in a directory on the server, for
+// development and single-server setups
+type LocalArtifactStore struct {
+	dir     string
+	baseURL string
+}
+
+// NewLocalArtifactStore returns a store writing to dir. Without a base URL
+// the store's URLs are file URLs.
+func NewLocalArtifactStore(dir, baseURL string) (*LocalArtifactStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("the local artifact store needs a directory")
+	}
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(absDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create artifact directory: %v", err)
+	}
+
+	return &LocalArtifactStore{dir: absDir, baseURL: strings.TrimSuffix(baseURL, "/")}, nil
+}
+
+// Put writes the file next to its final path and renames it into place, so
+// a file that exists is always complete
+func (s *LocalArtifactStore) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	target, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	temp := filepath.Join(filepath.Dir(target), ".tmp-"+uuid.New().String())
+	out, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp)
+
+	if _, err := io.Copy(out, &contextReader{ctx: ctx, reader: body}); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp, target)
+}
+
+func (s *LocalArtifactStore) Open(ctx context.Context, key string) (*Artifact, error) {
+	target, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrArtifactNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, ErrArtifactNotFound
+	}
+
+	// Stored files are never rewritten, so their size and time identify
+	// them
+	return &Artifact{
+		Body:        file,
+		Size:        info.Size(),
+		ModTime:     info.ModTime(),
+		ContentType: ContentType(key),
+		ETag:        fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()),
+	}, nil
+}
+
+func (s *LocalArtifactStore) DeletePrefix(ctx context.Context, prefix string) error {
+	target, err := s.path(prefix)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(target)
+}
+
+func (s *LocalArtifactStore) URL(key string) string {
+	if s.baseURL != "" {
+		return s.baseURL + "/" + key
+	}
+	return "file://" + filepath.ToSlash(filepath.Join(s.dir, filepath.FromSlash(key)))
+}
+
+// path returns where a key is stored, refusing keys that would leave the
+// store's directory
+func (s *LocalArtifactStore) path(key string) (string, error) {
+	if key == "" || path.IsAbs(key) || path.Clean(key) != key || key == ".." || strings.HasPrefix(key, "../") {
+		return "", fmt.Errorf("invalid artifact key %q", key)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+// contextReader stops a copy once its context is done
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
@@ -0,0 +1,151 @@
+package services
+
+import (
+	"breezy/config"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3ArtifactStore keeps deployments in a bucket of an S3-compatible object
+// store
+type S3ArtifactStore struct {
+	client  *minio.Client
+	bucket  string
+	baseURL string
+}
+
+// NewS3ArtifactStore returns a store writing to the configured bucket.
+// Without an endpoint, a Cloudflare account's R2 is used.
+func NewS3ArtifactStore(s3 config.S3, baseURL string, cloudflare config.Cloudflare) (*S3ArtifactStore, error) {
+	if s3.Bucket == "" {
+		return nil, fmt.Errorf("the S3 artifact store needs a bucket")
+	}
+
+	endpoint, region := s3.Endpoint, s3.Region
+	if endpoint == "" && cloudflare.AccountID != "" {
+		endpoint = fmt.Sprintf("https://%s.r2.cloudflarestorage.com", cloudflare.AccountID)
+		region = "auto"
+	}
+	if endpoint == "" {
+		return nil, fmt.Errorf("the S3 artifact store needs an endpoint")
+	}
+
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil || endpointURL.Host == "" || (endpointURL.Scheme != "http" && endpointURL.Scheme != "https") {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+	}
+
+	lookup := minio.BucketLookupAuto
+	if s3.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+	client, err := minio.New(endpointURL.Host, &minio.Options{
+		Creds:        credentials.NewStaticV4(s3.AccessKeyID, s3.SecretAccessKey, ""),
+		Secure:       endpointURL.Scheme == "https",
+		Region:       region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if baseURL == "" {
+		if s3.PathStyle {
+			baseURL = fmt.Sprintf("%s://%s/%s", endpointURL.Scheme, endpointURL.Host, s3.Bucket)
+		} else {
+			baseURL = fmt.Sprintf("%s://%s.%s", endpointURL.Scheme, s3.Bucket, endpointURL.Host)
+		}
+	}
+
+	return &S3ArtifactStore{
+		client:  client,
+		bucket:  s3.Bucket,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}, nil
+}
+
+func (s *S3ArtifactStore) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(ctx, s.bucket, key, body, size, minio.PutObjectOptions{
+		ContentType: contentType,
+	})
+	return err
+}
+
+func (s *S3ArtifactStore) Open(ctx context.Context, key string) (*Artifact, error) {
+	object, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// Getting an object is lazy; the stat is the first request made
+	info, err := object.Stat()
+	if err != nil {
+		object.Close()
+		if minio.ToErrorResponse(err).StatusCode == http.StatusNotFound {
+			return nil, ErrArtifactNotFound
+		}
+		return nil, err
+	}
+
+	// Objects uploaded by other tools may lack a useful type
+	objectType := info.ContentType
+	if objectType == "" || objectType == "binary/octet-stream" {
+		objectType = ContentType(key)
+	}
+	return &Artifact{
+		Body:        object,
+		Size:        info.Size,
+		ModTime:     info.LastModified,
+		ContentType: objectType,
+		ETag:        `"` + strings.Trim(info.ETag, `"`) + `"`,
+	}, nil
+}
+
+// DeletePrefix lists the objects under the prefix and removes them in
+// batches
+func (s *S3ArtifactStore) DeletePrefix(ctx context.Context, prefix string) error {
+	objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:    strings.TrimSuffix(prefix, "/") + "/",
+		Recursive: true,
+	})
+
+	// Listing errors arrive as objects, and end the removal
+	var listErr error
+	keys := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(keys)
+		for object := range objects {
+			if object.Err != nil {
+				listErr = object.Err
+				return
+			}
+			select {
+			case keys <- object:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var removeErr error
+	for result := range s.client.RemoveObjects(ctx, s.bucket, keys, minio.RemoveObjectsOptions{}) {
+		if removeErr == nil {
+			removeErr = fmt.Errorf("failed to remove %s: %v", result.ObjectName, result.Err)
+		}
+	}
+	if listErr != nil {
+		return listErr
+	}
+	return removeErr
+}
+
+func (s *S3ArtifactStore) URL(key string) string {
+	return s.baseURL + "/" + key
+}
@@ -0,0 +1,237 @@
+package services
+
+import (
+	"breezy/config"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+)
+
+// buildOutput is a Flutter web build, by path in build/web
+var buildOutput = map[string]struct {
+	content     string
+	contentType string
+}{
+	"index.html":                       {"<!DOCTYPE html><html></html>", "text/html; charset=utf-8"},
+	"main.dart.js":                     {"void main() {}", "text/javascript; charset=utf-8"},
+	"flutter_service_worker.js":        {"self.addEventListener('fetch', () => {});", "text/javascript; charset=utf-8"},
+	"manifest.json":                    {`{"name":"app"}`, "application/json"},
+	"canvaskit/canvaskit.wasm":         {"\x00asm\x01\x00\x00\x00", "application/wasm"},
+	"assets/AssetManifest.json":        {"{}", "application/json"},
+	"assets/fonts/MaterialIcons.otf":   {"OTTO", "font/otf"},
+	"icons/Icon-192.png":               {"\x89PNG\r\n\x1a\n", "image/png"},
+	"assets/packages/app/data.unknown": {"data", "application/octet-stream"},
+}
+
+// writeBuildOutput writes buildOutput to a project's build/web directory
+// and returns the directory
+func writeBuildOutput(t *testing.T) string {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "build", "web")
+	for name, file := range buildOutput {
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(target, []byte(file.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// testArtifactStore uploads the build output of two deployments of an app
+// to a store, checks the stored files, and removes one deployment. The
+// deployment IDs share a prefix, so removing one must not reach the other.
+func testArtifactStore(t *testing.T, store ArtifactStore, appID string) {
+	ctx := context.Background()
+	dir := writeBuildOutput(t)
+
+	removed := deploymentArtifactPrefix(appID, "d1")
+	kept := deploymentArtifactPrefix(appID, "d10")
+	for _, prefix := range []string{removed, kept} {
+		upload, err := uploadArtifacts(ctx, store, dir, prefix, io.Discard)
+		if err != nil {
+			t.Fatalf("uploading %s: %v", prefix, err)
+		}
+		if upload.Files != len(buildOutput) {
+			t.Errorf("uploaded %d files to %s, want %d", upload.Files, prefix, len(buildOutput))
+		}
+		// The URL is stored as the deployment's staticFilesURL
+		if want := store.URL(prefix) + "/"; upload.URL != want {
+			t.Errorf("upload URL of %s is %q, want %q", prefix, upload.URL, want)
+		}
+	}
+
+	for name, file := range buildOutput {
+		artifact, err := store.Open(ctx, path.Join(removed, name))
+		if err != nil {
+			t.Errorf("opening %s: %v", name, err)
+			continue
+		}
+		body, err := io.ReadAll(artifact.Body)
+		artifact.Body.Close()
+		if err != nil {
+			t.Errorf("reading %s: %v", name, err)
+			continue
+		}
+		if string(body) != file.content {
+			t.Errorf("%s holds %q, want %q", name, body, file.content)
+		}
+		if artifact.Size != int64(len(file.content)) {
+			t.Errorf("%s has size %d, want %d", name, artifact.Size, len(file.content))
+		}
+		if artifact.ContentType != file.contentType {
+			t.Errorf("%s has content type %q, want %q", name, artifact.ContentType, file.contentType)
+		}
+		if artifact.ETag == "" {
+			t.Errorf("%s has no ETag", name)
+		}
+	}
+
+	if _, err := store.Open(ctx, path.Join(removed, "missing.html")); !errors.Is(err, ErrArtifactNotFound) {
+		t.Errorf("opening a missing file returned %v, want ErrArtifactNotFound", err)
+	}
+
+	if err := store.DeletePrefix(ctx, removed); err != nil {
+		t.Fatalf("deleting %s: %v", removed, err)
+	}
+	for name := range buildOutput {
+		if _, err := store.Open(ctx, path.Join(removed, name)); !errors.Is(err, ErrArtifactNotFound) {
+			t.Errorf("opening deleted %s returned %v, want ErrArtifactNotFound", name, err)
+		}
+		artifact, err := store.Open(ctx, path.Join(kept, name))
+		if err != nil {
+			t.Errorf("deleting %s removed %s of %s: %v", removed, name, kept, err)
+			continue
+		}
+		artifact.Body.Close()
+	}
+}
+
+func TestLocalArtifactStore(t *testing.T) {
+	tests := []struct {
+		name    string
+		baseURL string
+		wantURL func(dir string) string
+	}{
+		{
+			name:    "file URLs",
+			wantURL: func(dir string) string { return "file://" + filepath.ToSlash(dir) + "/apps/app/deployments/d1" },
+		},
+		{
+			name:    "base URL",
+			baseURL: "https://static.example.com/",
+			wantURL: func(string) string { return "https://static.example.com/apps/app/deployments/d1" },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := NewLocalArtifactStore(dir, tt.baseURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := store.URL(deploymentArtifactPrefix("app", "d1")), tt.wantURL(dir); got != want {
+				t.Errorf("URL is %q, want %q", got, want)
+			}
+			testArtifactStore(t, store, "app")
+		})
+	}
+}
+
+func TestLocalArtifactStoreKeys(t *testing.T) {
+	store, err := NewLocalArtifactStore(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key   string
+		valid bool
+	}{
+		{"apps/app/deployments/d1/index.html", true},
+		{"", false},
+		{"/etc/passwd", false},
+		{"..", false},
+		{"../outside", false},
+		{"apps/../../outside", false},
+		{"apps//index.html", false},
+		{"apps/./index.html", false},
+	}
+
+	for _, tt := range tests {
+		err := store.Put(context.Background(), tt.key, strings.NewReader("x"), 1, "text/plain")
+		if tt.valid && err != nil {
+			t.Errorf("Put(%q) failed: %v", tt.key, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("Put(%q) succeeded, want an invalid key error", tt.key)
+		}
+	}
+}
+
+// TestS3ArtifactStore runs against an S3-compatible server such as a local
+// MinIO, and is skipped unless S3_TEST_ENDPOINT is set. The bucket is
+// created if it doesn't exist.
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//	S3_TEST_ENDPOINT=http://localhost:9000 go test ./services -run S3
+func TestS3ArtifactStore(t *testing.T) {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT is not set")
+	}
+
+	s3 := config.S3{
+		Endpoint:        endpoint,
+		Region:          envOr("S3_TEST_REGION", "us-east-1"),
+		Bucket:          envOr("S3_TEST_BUCKET", "breezy-test"),
+		AccessKeyID:     envOr("S3_TEST_ACCESS_KEY_ID", "minioadmin"),
+		SecretAccessKey: envOr("S3_TEST_SECRET_ACCESS_KEY", "minioadmin"),
+		PathStyle:       true,
+	}
+	store, err := NewS3ArtifactStore(s3, "", config.Cloudflare{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	exists, err := store.client.BucketExists(ctx, s3.Bucket)
+	if err != nil {
+		t.Fatalf("reaching %s: %v", endpoint, err)
+	}
+	if !exists {
+		if err := store.client.MakeBucket(ctx, s3.Bucket, minio.MakeBucketOptions{Region: s3.Region}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Runs don't share files, and clean up after themselves
+	appID := uuid.New().String()
+	t.Cleanup(func() {
+		store.DeletePrefix(context.Background(), path.Join("apps", appID))
+	})
+
+	prefix := deploymentArtifactPrefix(appID, "d1")
+	if got, want := store.URL(prefix), strings.TrimSuffix(endpoint, "/")+"/"+s3.Bucket+"/"+prefix; got != want {
+		t.Errorf("URL is %q, want %q", got, want)
+	}
+	testArtifactStore(t, store, appID)
+}
+
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,57 @@
+package services
+
+import (
+	"breezy/model"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// skipDeployMarker in the message of a pushed commit skips deploying it
+const skipDeployMarker = "[skip breezy]"
+
+// HandlePushEvent deploys every app of apps, those built from the
+// repository, that tracks the pushed branch and has auto-deploy on. It
+// returns what the push did for each app.
+func (bs *BuildService) HandlePushEvent(event *model.GitHubWebhookPayload, apps []model.App) ([]model.WebhookDeliveryResult, error) {
+	branch, isBranch := strings.CutPrefix(event.Ref, "refs/heads/")
+	switch {
+	case !isBranch:
+		return deliveryResults(apps, fmt.Sprintf("%s isn't a branch", event.Ref)), nil
+	case event.Deleted:
+		return deliveryResults(apps, fmt.Sprintf("Branch %s was deleted", branch)), nil
+	case strings.Contains(strings.ToLower(event.HeadCommit.Message), skipDeployMarker):
+		logrus.Infof("Not deploying %s of %s, its commit asks to be skipped", shortHash(event.After), event.Repository.FullName)
+		return deliveryResults(apps, fmt.Sprintf("The commit asks to be skipped with %s", skipDeployMarker)), nil
+	}
+
+	results := make([]model.WebhookDeliveryResult, 0, len(apps))
+	var errs error
+	for _, app := range apps {
+		result := model.WebhookDeliveryResult{AppId: app.Id}
+		switch {
+		case app.Branch != branch:
+			result.Message = fmt.Sprintf("The app tracks %s, not %s", app.Branch, branch)
+		case !app.AutoDeploy:
+			result.Message = "Auto-deploy is off"
+		default:
+			job, err := bs.EnqueueBuild(app.Id.Hex(), app.UserId.Hex(), event.Repository.CloneURL, branch, BuildOptions{
+				CommitSha:     event.After,
+				CommitMessage: event.HeadCommit.Message,
+			})
+			if err != nil {
+				logrus.WithError(err).Errorf("Failed to queue deployment of %s for app %s", shortHash(event.After), app.Id.Hex())
+				errs = errors.Join(errs, err)
+				result.Message = fmt.Sprintf("Failed to queue deployment: %v", err)
+				break
+			}
+			logrus.Infof("Queued build %s of %s@%s for app %s", job.Id, event.Repository.FullName, shortHash(event.After), app.Id.Hex())
+			result.DeploymentId = &job.DeploymentId
+			result.Message = "Deployment queued"
+		}
+		results = append(results, result)
+	}
+	return results, errs
+}
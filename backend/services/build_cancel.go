@@ -0,0 +1,150 @@
+package services
+
+import (
+	"breezy/model"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrBuildNotActive is returned when cancelling a build that has already
+// finished
+var ErrBuildNotActive = errors.New("build is not queued or running")
+
+// CancelBuild cancels the user's queued or running build for a deployment.
+// It returns mongo.ErrNoDocuments if the deployment doesn't belong to one of
+// the user's apps.
+func (bs *BuildService) CancelBuild(deploymentID, userID primitive.ObjectID) error {
+	deployment, err := bs.getDeployment(deploymentID)
+	if err != nil {
+		return err
+	}
+
+	count, err := bs.db.Collection("apps").CountDocuments(context.Background(), bson.M{
+		"_id":    deployment.AppId,
+		"userId": userID,
+	})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	cancelled, err := bs.stopBuild(deployment, userID.Hex(), model.DeploymentStatusCancelled, "Build cancelled")
+	if err != nil {
+		return err
+	}
+	if !cancelled {
+		return ErrBuildNotActive
+	}
+	return nil
+}
+
+// supersedeBuilds stops every queued or running build of the app's branch
+// other than the given deployment, so that only the latest request for a
+// branch is built and goes live. Builds of a pull request's preview only
+// supersede each other.
+func (bs *BuildService) supersedeBuilds(appID, userID primitive.ObjectID, branch string, pullRequest int, latest primitive.ObjectID) {
+	filter := bson.M{
+		"appId":       appID,
+		"branch":      branch,
+		"pullRequest": pullRequest,
+		"status":      bson.M{"$in": activeDeploymentStatuses},
+		"_id":         bson.M{"$ne": latest},
+	}
+	if pullRequest == 0 {
+		filter["pullRequest"] = bson.M{"$exists": false}
+	}
+	cursor, err := bs.db.Collection("deployments").Find(context.Background(), filter)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to find builds superseded by %s", latest.Hex())
+		return
+	}
+
+	var deployments []model.Deployment
+	if err := cursor.All(context.Background(), &deployments); err != nil {
+		logrus.WithError(err).Errorf("Failed to find builds superseded by %s", latest.Hex())
+		return
+	}
+
+	for i := range deployments {
+		message := fmt.Sprintf("Superseded by deployment %s", latest.Hex())
+		if _, err := bs.stopBuild(&deployments[i], userID.Hex(), model.DeploymentStatusSuperseded, message); err != nil {
+			logrus.WithError(err).Errorf("Failed to supersede build %s", deployments[i].Id.Hex())
+		}
+	}
+}
+
+// stopBuild moves an active deployment to a final status and stops its
+// build: a queued job is removed from the queue, and a running build is
+// stopped by the worker holding it, which kills the current step and cleans
+// up the workspace. It reports false if the build had already finished.
+func (bs *BuildService) stopBuild(deployment *model.Deployment, userID string, status model.DeploymentStatus, message string) (bool, error) {
+	deploymentID := deployment.Id
+
+	// Marking the deployment first means a worker that picks the job up
+	// from here on skips it, even if the queue removal below loses the race
+	stopped, err := bs.transitionDeployment(deploymentID, activeDeploymentStatuses, status, message)
+	if err != nil || !stopped {
+		return false, err
+	}
+
+	ctx := context.Background()
+	removed, err := bs.queue.Remove(ctx, userID, deploymentID.Hex())
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to remove %s build %s from the queue", status, deploymentID.Hex())
+	}
+	if err := bs.queue.PublishCancellation(ctx, deploymentID.Hex()); err != nil {
+		logrus.WithError(err).Errorf("Failed to publish cancellation of build %s", deploymentID.Hex())
+	}
+
+	bs.wsService.BroadcastUpdate(BuildUpdate{
+		Type:         "build_update",
+		AppID:        deployment.AppId.Hex(),
+		UserID:       userID,
+		DeploymentID: deploymentID.Hex(),
+		Status:       string(status),
+		Message:      message,
+		Timestamp:    time.Now(),
+	})
+	if removed {
+		bs.BroadcastQueuePositions()
+	}
+	bs.reportCommitStatus(deploymentID, commitStateError, message)
+	return true, nil
+}
+
+// WatchCancellations stops running builds on this worker when they are
+// cancelled from any server process
+func (bs *BuildService) WatchCancellations(ctx context.Context) {
+	for deploymentID := range bs.queue.Cancellations(ctx) {
+		bs.mutex.Lock()
+		cancel, ok := bs.running[deploymentID]
+		bs.mutex.Unlock()
+
+		if ok {
+			logrus.Infof("Cancelling running build for deployment %s", deploymentID)
+			cancel()
+		}
+	}
+}
+
+// trackBuild registers a running build so it can be cancelled
+func (bs *BuildService) trackBuild(deploymentID primitive.ObjectID, cancel context.CancelFunc) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	bs.running[deploymentID.Hex()] = cancel
+}
+
+func (bs *BuildService) untrackBuild(deploymentID primitive.ObjectID) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	delete(bs.running, deploymentID.Hex())
+}
@@ -0,0 +1,339 @@
+package services
+
+import (
+	"breezy/model"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"gopkg.in/yaml.v3"
+)
+
+// buildConfigFile is the build configuration committed at the root of the
+// repository
+const buildConfigFile = "breezy.yaml"
+
+var dartDefinePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// BuildConfig is the build configuration read from breezy.yaml, or from the
+// `breezy:` section of the root pubspec.yaml when there is no breezy.yaml
+type BuildConfig struct {
+	// Path is the Flutter project directory, relative to the repository root
+	Path    string               `yaml:"path" validate:"omitempty,max=255,relpath"`
+	Flutter FlutterConfig        `yaml:"flutter"`
+	Build   FlutterBuildSettings `yaml:"build"`
+	// OutputDir is where the built app is written, relative to Path
+	OutputDir string `yaml:"outputDir" validate:"omitempty,max=255,relpath"`
+	// PreBuild commands run in the project directory after dependencies are
+	// fetched and before the app is built
+	PreBuild []string `yaml:"preBuild" validate:"max=20,dive,required,max=1000"`
+	// PostBuild commands run in the project directory after the app is built
+	PostBuild []string `yaml:"postBuild" validate:"max=20,dive,required,max=1000"`
+
+	// file is where the configuration was read from, if anywhere
+	file string
+}
+
+// FlutterConfig selects the Flutter SDK. A version takes precedence over a
+// channel.
+type FlutterConfig struct {
+	Channel string `yaml:"channel" validate:"omitempty,oneof=stable beta master main"`
+	Version string `yaml:"version" validate:"omitempty,flutterversion"`
+}
+
+// FlutterBuildSettings are passed to the build command. Only Flags applies
+// to frameworks other than Flutter.
+type FlutterBuildSettings struct {
+	Renderer    string            `yaml:"renderer" validate:"omitempty,oneof=auto canvaskit html"`
+	Wasm        bool              `yaml:"wasm"`
+	DartDefines map[string]string `yaml:"dartDefines" validate:"max=100,dive,keys,dartdefine,endkeys,max=1000"`
+	Flags       []string          `yaml:"flags" validate:"max=50,dive,required,startswith=-,max=255"`
+}
+
+// BuildConfigError is returned when the repository's build configuration
+// can't be read or is invalid
+type BuildConfigError struct {
+	File     string
+	Problems []string
+}
+
+func (e *BuildConfigError) Error() string {
+	if e.File == "" {
+		return "invalid build configuration: " + strings.Join(e.Problems, "; ")
+	}
+	return fmt.Sprintf("invalid %s: %s", e.File, strings.Join(e.Problems, "; "))
+}
+
+var buildConfigValidator = newBuildConfigValidator()
+
+func newBuildConfigValidator() *validator.Validate {
+	validate := validator.New()
+
+	// Report fields by their name in the YAML file
+	validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("yaml"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+
+	validate.RegisterValidation("relpath", func(fl validator.FieldLevel) bool {
+		path := fl.Field().String()
+		clean := filepath.Clean(path)
+		return !filepath.IsAbs(path) && clean != ".." && !strings.HasPrefix(clean, "../")
+	})
+	validate.RegisterValidation("flutterversion", func(fl validator.FieldLevel) bool {
+		return model.FlutterVersionPattern.MatchString(fl.Field().String())
+	})
+	validate.RegisterValidation("dartdefine", func(fl validator.FieldLevel) bool {
+		return dartDefinePattern.MatchString(fl.Field().String())
+	})
+
+	return validate
+}
+
+// loadBuildConfig reads and validates the build configuration of the
+// repository checked out at repoPath. A repository without one gets the
+// defaults.
+func loadBuildConfig(repoPath string) (*BuildConfig, string, error) {
+	config := &BuildConfig{}
+
+	file := buildConfigFile
+	data, err := readProjectFile(repoPath, buildConfigFile)
+	switch {
+	case err == nil:
+		if err := decodeBuildConfig(data, config); err != nil {
+			return nil, file, &BuildConfigError{File: file, Problems: []string{err.Error()}}
+		}
+	case errors.Is(err, os.ErrNotExist):
+		file = "pubspec.yaml"
+		found, err := loadPubspecBuildConfig(repoPath, config)
+		if err != nil {
+			return nil, file, &BuildConfigError{File: file, Problems: []string{err.Error()}}
+		}
+		if !found {
+			file = ""
+		}
+	default:
+		return nil, file, fmt.Errorf("failed to read %s: %v", buildConfigFile, err)
+	}
+
+	config.file = file
+	if problems := config.validate(repoPath); len(problems) > 0 {
+		return nil, file, &BuildConfigError{File: file, Problems: problems}
+	}
+
+	return config, file, nil
+}
+
+// loadPubspecBuildConfig reads the `breezy:` section of the root
+// pubspec.yaml, reporting whether there was one
+func loadPubspecBuildConfig(repoPath string, config *BuildConfig) (bool, error) {
+	data, err := readProjectFile(repoPath, "pubspec.yaml")
+	if err != nil {
+		// The project may live in a subdirectory; a missing pubspec.yaml is
+		// reported when the project is configured
+		return false, nil
+	}
+
+	var pubspec struct {
+		Breezy yaml.Node `yaml:"breezy"`
+	}
+	if err := yaml.Unmarshal(data, &pubspec); err != nil {
+		// A broken pubspec.yaml is reported when the project is configured
+		return false, nil
+	}
+	if pubspec.Breezy.IsZero() {
+		return false, nil
+	}
+
+	section, err := yaml.Marshal(&pubspec.Breezy)
+	if err != nil {
+		return false, err
+	}
+	return true, decodeBuildConfig(section, config)
+}
+
+// decodeBuildConfig decodes a build configuration, rejecting unknown keys
+// so typos don't go unnoticed
+func decodeBuildConfig(data []byte, config *BuildConfig) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(config); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// validate checks the configuration against its schema and returns every
+// problem found
+func (c *BuildConfig) validate(repoPath string) []string {
+	problems := []string{}
+
+	if err := buildConfigValidator.Struct(c); err != nil {
+		var fieldErrors validator.ValidationErrors
+		if !errors.As(err, &fieldErrors) {
+			return []string{err.Error()}
+		}
+		for _, fieldError := range fieldErrors {
+			problems = append(problems, describeFieldError(fieldError))
+		}
+	}
+
+	if c.Build.Wasm && c.Build.Renderer != "" {
+		problems = append(problems, "build.renderer: can't be set together with build.wasm")
+	}
+
+	if len(problems) == 0 && c.Path != "" {
+		if _, err := c.ProjectPath(repoPath); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	return problems
+}
+
+// describeFieldError turns a validation error into a message that names the
+// setting as it is written in the YAML file
+func describeFieldError(fieldError validator.FieldError) string {
+	// Drop the root struct name from e.g. "BuildConfig.build.renderer"
+	field := fieldError.Namespace()
+	if i := strings.Index(field, "."); i >= 0 {
+		field = field[i+1:]
+	}
+
+	switch fieldError.Tag() {
+	case "oneof":
+		return fmt.Sprintf("%s: must be one of %s", field, strings.ReplaceAll(fieldError.Param(), " ", ", "))
+	case "relpath":
+		return fmt.Sprintf("%s: must be a path inside the repository", field)
+	case "flutterversion":
+		return fmt.Sprintf("%s: must be a Flutter version like 3.24.5", field)
+	case "dartdefine":
+		return fmt.Sprintf("%s: %q is not a valid dart-define name", field, fieldError.Value())
+	case "startswith":
+		return fmt.Sprintf("%s: flags must start with %q", field, fieldError.Param())
+	case "required":
+		return fmt.Sprintf("%s: must not be empty", field)
+	case "max":
+		if kind := fieldError.Kind(); kind == reflect.Slice || kind == reflect.Map {
+			return fmt.Sprintf("%s: must have at most %s entries", field, fieldError.Param())
+		}
+		return fmt.Sprintf("%s: must be at most %s characters", field, fieldError.Param())
+	default:
+		return fmt.Sprintf("%s: failed %s validation", field, fieldError.Tag())
+	}
+}
+
+// ProjectPath returns the Flutter project directory inside the repository
+// checked out at repoPath
+func (c *BuildConfig) ProjectPath(repoPath string) (string, error) {
+	projectPath, err := resolveWithin(repoPath, c.Path)
+	if err != nil {
+		return "", fmt.Errorf("path: %v", err)
+	}
+	if info, err := os.Stat(projectPath); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("path: %s is not a directory", c.Path)
+	}
+	return projectPath, nil
+}
+
+// readProjectFile reads a file from a checked out repository. The file must
+// not be a symlink leading out of root, or a repository could have the
+// server read and echo its own files.
+func readProjectFile(root, name string) ([]byte, error) {
+	if _, err := os.Stat(filepath.Join(root, name)); err != nil {
+		return nil, err
+	}
+
+	path, err := resolveWithin(root, name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+// resolveWithin joins a relative path onto root and makes sure that,
+// following symlinks, it doesn't lead out of root. Build commands can create
+// arbitrary symlinks, so anything the server reads from a workspace goes
+// through here.
+func resolveWithin(root, path string) (string, error) {
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(root, path))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("%s does not exist", path)
+		}
+		return "", err
+	}
+
+	relative, err := filepath.Rel(resolvedRoot, resolved)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, "../") {
+		return "", fmt.Errorf("%s points outside the repository", path)
+	}
+	return resolved, nil
+}
+
+// ProjectDir returns the project directory relative to the build workspace
+func (c *BuildConfig) ProjectDir() string {
+	return filepath.Join(sourceDir, c.Path)
+}
+
+// OutputPath returns the directory the built app is written to, relative to
+// the project directory, falling back to the builder's default
+func (c *BuildConfig) OutputPath(builder Builder, project *BuildProject) string {
+	if c.OutputDir == "" {
+		return builder.OutputDir(project)
+	}
+	return filepath.Clean(c.OutputDir)
+}
+
+// checkFramework reports settings that don't apply to the builder
+func (c *BuildConfig) checkFramework(builder Builder) error {
+	if builder.Name() == model.FrameworkFlutter {
+		return nil
+	}
+
+	problems := []string{}
+	if c.Flutter != (FlutterConfig{}) {
+		problems = append(problems, fmt.Sprintf("flutter: only applies to Flutter projects, not %s", builder.Name()))
+	}
+	if c.Build.Renderer != "" || c.Build.Wasm || len(c.Build.DartDefines) > 0 {
+		problems = append(problems, fmt.Sprintf("build: renderer, wasm and dartDefines only apply to Flutter projects, not %s", builder.Name()))
+	}
+	if len(problems) > 0 {
+		return &BuildConfigError{File: c.file, Problems: problems}
+	}
+	return nil
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// FlutterSDK returns the requested Flutter version or channel, or "" for
+// the default SDK
+func (c *BuildConfig) FlutterSDK() string {
+	if c.Flutter.Version != "" {
+		return c.Flutter.Version
+	}
+	return c.Flutter.Channel
+}
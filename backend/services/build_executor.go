@@ -0,0 +1,143 @@
+package services
+
+import (
+	"breezy/config"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+const (
+	BuildExecutorDocker = "docker"
+	BuildExecutorHost   = "host"
+)
+
+// BuildCommand is a single command run against a build workspace
+type BuildCommand struct {
+	// Name identifies the command, e.g. the build step it belongs to
+	Name string
+	// Workspace is the host directory holding everything the build may touch
+	Workspace string
+	// Dir is the working directory, relative to Workspace
+	Dir string
+	// Args is the command and its arguments
+	Args []string
+	// Env holds extra KEY=value environment variables
+	Env []string
+	// SecretEnv holds KEY=value environment variables with secret values.
+	// Executors never put them on a command line.
+	SecretEnv []string
+	// Network allows the command to reach the network
+	Network bool
+	// Toolchain selects the tools the command needs, e.g. ToolchainNode.
+	// Empty uses the default build image.
+	Toolchain string
+	// FlutterSDK selects the Flutter SDK by version or channel. Empty uses
+	// the default SDK.
+	FlutterSDK string
+	// Mirror is the host path of a repository mirror the command may read.
+	// It is available read-only at the same path.
+	Mirror string
+	// Output receives stdout and stderr
+	Output io.Writer
+}
+
+// BuildExecutor runs build commands. Implementations must stop the command
+// when ctx is done.
+type BuildExecutor interface {
+	Run(ctx context.Context, cmd BuildCommand) error
+	// FlutterSDKs lists the Flutter versions and channels installed besides
+	// the default SDK
+	FlutterSDKs(ctx context.Context) ([]string, error)
+}
+
+// NewBuildExecutor returns the executor selected by the build config
+func NewBuildExecutor(env *config.Environment) (BuildExecutor, error) {
+	switch env.Build.Executor {
+	case BuildExecutorDocker, "":
+		return NewDockerExecutor(env.Docker), nil
+	case BuildExecutorHost:
+		return &HostExecutor{flutterSDKDir: env.Build.FlutterSDKDir}, nil
+	default:
+		return nil, fmt.Errorf("unknown build executor %q", env.Build.Executor)
+	}
+}
+
+// HostExecutor runs build commands directly on the server as the server
+// user. It gives builds full access to the host and is only meant for
+// local development. The default Flutter SDK is the one in PATH; others
+// are looked up in the Flutter SDK directory.
+type HostExecutor struct {
+	flutterSDKDir string
+}
+
+func (e *HostExecutor) Run(ctx context.Context, command BuildCommand) error {
+	if _, err := exec.LookPath(command.Args[0]); err != nil {
+		return fmt.Errorf("%s is not installed or not in PATH: %v", command.Args[0], err)
+	}
+
+	workspace, err := filepath.Abs(command.Workspace)
+	if err != nil {
+		return err
+	}
+
+	// Use the workspace's pub cache, which the dependency cache fills, like
+	// the docker executor does
+	env := append(os.Environ(), "PUB_CACHE="+filepath.Join(workspace, pubCacheDir))
+	env = append(env, command.Env...)
+	env = append(env, command.SecretEnv...)
+	if command.FlutterSDK != "" {
+		sdk, err := e.flutterSDK(command.FlutterSDK)
+		if err != nil {
+			return err
+		}
+		// Later entries win, so this PATH replaces the server's
+		env = append(env, "PATH="+filepath.Join(sdk, "bin")+string(os.PathListSeparator)+os.Getenv("PATH"))
+	}
+
+	cmd := exec.CommandContext(ctx, command.Args[0], command.Args[1:]...)
+	cmd.Dir = filepath.Join(command.Workspace, command.Dir)
+	cmd.Env = env
+	cmd.Stdout = command.Output
+	cmd.Stderr = command.Output
+	cmd.WaitDelay = 10 * time.Second
+	setProcessGroup(cmd)
+
+	return cmd.Run()
+}
+
+func (e *HostExecutor) FlutterSDKs(ctx context.Context) ([]string, error) {
+	if e.flutterSDKDir == "" {
+		return nil, nil
+	}
+
+	entries, err := os.ReadDir(e.flutterSDKDir)
+	if err != nil {
+		return nil, err
+	}
+
+	sdks := []string{}
+	for _, entry := range entries {
+		if _, err := e.flutterSDK(entry.Name()); err == nil {
+			sdks = append(sdks, entry.Name())
+		}
+	}
+	return sdks, nil
+}
+
+// flutterSDK returns the directory of an installed Flutter SDK
+func (e *HostExecutor) flutterSDK(version string) (string, error) {
+	if e.flutterSDKDir == "" || filepath.Base(version) != version {
+		return "", fmt.Errorf("Flutter SDK %s is not installed", version)
+	}
+
+	sdk := filepath.Join(e.flutterSDKDir, version)
+	if !fileExists(filepath.Join(sdk, "bin", "flutter")) {
+		return "", fmt.Errorf("Flutter SDK %s is not installed", version)
+	}
+	return sdk, nil
+}
@@ -0,0 +1,140 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxStoredBuildLogSize caps the log kept on the deployment document so a
+// noisy build can't push it past MongoDB's document size limit. Lines past
+// the cap are still streamed over the WebSocket.
+const maxStoredBuildLogSize = 4 * 1024 * 1024
+
+// BuildLogLine is a single line of build output
+type BuildLogLine struct {
+	Timestamp time.Time `json:"timestamp"`
+	Step      string    `json:"step"`
+	Line      string    `json:"line"`
+}
+
+// BuildLog collects the output of every build step, streams each line to
+// the user's WebSocket clients and persists the full log on the deployment
+type BuildLog struct {
+	bs           *BuildService
+	userID       string
+	appID        string
+	deploymentID primitive.ObjectID
+
+	mutex     sync.Mutex
+	buffer    strings.Builder
+	truncated bool
+}
+
+func (bs *BuildService) newBuildLog(userID, appID string, deploymentID primitive.ObjectID) *BuildLog {
+	return &BuildLog{
+		bs:           bs,
+		userID:       userID,
+		appID:        appID,
+		deploymentID: deploymentID,
+	}
+}
+
+// Printf records a single line for the given step
+func (l *BuildLog) Printf(step, format string, args ...any) {
+	l.append(step, fmt.Sprintf(format, args...))
+}
+
+// Writer returns a writer that records everything written to it, line by
+// line, under the given step. It should be closed once the step finishes
+// to flush a trailing partial line.
+func (l *BuildLog) Writer(step string) *BuildLogWriter {
+	return &BuildLogWriter{log: l, step: step}
+}
+
+// String returns the log collected so far
+func (l *BuildLog) String() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.buffer.String()
+}
+
+// Save persists the log collected so far on the deployment
+func (l *BuildLog) Save() {
+	collection := l.bs.db.Collection("deployments")
+
+	update := bson.M{
+		"$set": bson.M{
+			"buildLogs": l.String(),
+			"logsURL":   fmt.Sprintf("/api/deployments/%s/logs", l.deploymentID.Hex()),
+		},
+	}
+
+	if _, err := collection.UpdateOne(context.Background(), bson.M{"_id": l.deploymentID}, update); err != nil {
+		log.WithError(err).Errorf("Failed to save build logs for deployment %s", l.deploymentID.Hex())
+	}
+}
+
+func (l *BuildLog) append(step, line string) {
+	entry := BuildLogLine{
+		Timestamp: time.Now(),
+		Step:      step,
+		Line:      line,
+	}
+
+	l.mutex.Lock()
+	formatted := fmt.Sprintf("%s [%s] %s\n", entry.Timestamp.UTC().Format(time.RFC3339), step, line)
+	if l.buffer.Len()+len(formatted) <= maxStoredBuildLogSize {
+		l.buffer.WriteString(formatted)
+	} else if !l.truncated {
+		l.truncated = true
+		l.buffer.WriteString("... log truncated, see the live stream for the remaining output\n")
+	}
+	l.mutex.Unlock()
+
+	l.bs.wsService.BroadcastUpdate(BuildUpdate{
+		Type:         "build_log",
+		AppID:        l.appID,
+		UserID:       l.userID,
+		DeploymentID: l.deploymentID.Hex(),
+		Message:      line,
+		Data:         entry,
+		Timestamp:    entry.Timestamp,
+	})
+}
+
+// BuildLogWriter splits command output into lines for a BuildLog
+type BuildLogWriter struct {
+	log     *BuildLog
+	step    string
+	partial []byte
+}
+
+func (w *BuildLogWriter) Write(p []byte) (int, error) {
+	data := append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		w.log.append(w.step, strings.TrimRight(string(data[:i]), "\r"))
+		data = data[i+1:]
+	}
+	w.partial = append([]byte(nil), data...)
+	return len(p), nil
+}
+
+// Close flushes any trailing output that did not end in a newline
+func (w *BuildLogWriter) Close() error {
+	if len(w.partial) > 0 {
+		w.log.append(w.step, strings.TrimRight(string(w.partial), "\r"))
+		w.partial = nil
+	}
+	return nil
+}
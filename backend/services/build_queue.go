@@ -0,0 +1,398 @@
+package services
+
+import (
+	"breezy/config"
+	"breezy/model"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	buildQueueName = "build_jobs"
+
+	// buildCancellationsChannel carries the IDs of deployments whose running
+	// build should be stopped by whichever worker holds it
+	buildCancellationsChannel = "build_cancellations"
+
+	// workerHeartbeatTTL is how long a worker is considered alive after its
+	// last heartbeat. Jobs held by a worker whose heartbeat expired are
+	// pushed back onto the queue.
+	workerHeartbeatTTL = 30 * time.Second
+)
+
+// enqueueScript pushes a job onto its user's queue and adds the user to the
+// back of the rotation if they had nothing queued
+var enqueueScript = redis.NewScript(`
+if redis.call('LPUSH', KEYS[1], ARGV[1]) == 1 then
+	redis.call('RPUSH', KEYS[2], ARGV[2])
+end
+return 1
+`)
+
+// dequeueScript takes the next job in round-robin order across users,
+// skipping users at their concurrency cap and jobs for apps that are already
+// building, and moves it into the worker's processing list. Nothing is taken
+// while the global limit is reached.
+var dequeueScript = redis.NewScript(`
+local total = 0
+for _, count in ipairs(redis.call('HVALS', KEYS[2])) do
+	total = total + tonumber(count)
+end
+if total >= tonumber(ARGV[2]) then
+	return false
+end
+
+local users = redis.call('LLEN', KEYS[1])
+for i = 1, users do
+	local user = redis.call('LPOP', KEYS[1])
+	local queue = ARGV[1] .. user
+	local pending = redis.call('LLEN', queue)
+	if pending > 0 then
+		local running = tonumber(redis.call('HGET', KEYS[2], user) or '0')
+		local payload = false
+		local app = false
+		if running < tonumber(ARGV[3]) then
+			-- Jobs are taken oldest first, from the right
+			local payloads = redis.call('LRANGE', queue, 0, -1)
+			for j = #payloads, 1, -1 do
+				local candidate = cjson.decode(payloads[j])['appId']
+				if redis.call('SISMEMBER', KEYS[4], candidate) == 0 then
+					payload = payloads[j]
+					app = candidate
+					break
+				end
+			end
+		end
+		if not payload then
+			redis.call('RPUSH', KEYS[1], user)
+		else
+			redis.call('LREM', queue, -1, payload)
+			redis.call('LPUSH', KEYS[3], payload)
+			redis.call('HINCRBY', KEYS[2], user, 1)
+			redis.call('SADD', KEYS[4], app)
+			if pending > 1 then
+				redis.call('RPUSH', KEYS[1], user)
+			end
+			return payload
+		end
+	end
+end
+return false
+`)
+
+// ackScript removes a finished job from the processing list and frees its
+// user's slot and its app. Without a user and app they are read from the
+// payload, for jobs dropped without being decoded. Acking twice is a no-op.
+var ackScript = redis.NewScript(`
+if redis.call('LREM', KEYS[1], 1, ARGV[1]) == 0 then
+	return 0
+end
+local user = ARGV[2]
+local app = ARGV[3]
+if user == '' then
+	local ok, job = pcall(cjson.decode, ARGV[1])
+	if not ok or type(job) ~= 'table' then
+		return 1
+	end
+	user = tostring(job['userId'])
+	app = tostring(job['appId'])
+end
+if redis.call('HINCRBY', KEYS[2], user, -1) <= 0 then
+	redis.call('HDEL', KEYS[2], user)
+end
+redis.call('SREM', KEYS[3], app)
+return 1
+`)
+
+// removeScript deletes a pending job, dropping its user from the rotation
+// if that leaves them with nothing queued
+var removeScript = redis.NewScript(`
+local removed = redis.call('LREM', KEYS[1], 1, ARGV[1])
+if removed > 0 and redis.call('LLEN', KEYS[1]) == 0 then
+	redis.call('LREM', KEYS[2], 0, ARGV[2])
+end
+return removed
+`)
+
+// requeueScript moves every job in a dead worker's processing list back to
+// the front of its user's queue and frees the slots and apps they held
+var requeueScript = redis.NewScript(`
+local requeued = 0
+while true do
+	local payload = redis.call('RPOP', KEYS[1])
+	if not payload then
+		break
+	end
+	local job = cjson.decode(payload)
+	local user = job['userId']
+	if redis.call('RPUSH', ARGV[1] .. user, payload) == 1 then
+		redis.call('LPUSH', KEYS[2], user)
+	end
+	if redis.call('HINCRBY', KEYS[3], user, -1) <= 0 then
+		redis.call('HDEL', KEYS[3], user)
+	end
+	redis.call('SREM', KEYS[4], job['appId'])
+	requeued = requeued + 1
+end
+return requeued
+`)
+
+// BuildQueue is a reliable, fair Redis queue for build jobs. Each user has
+// their own queue and users are served round-robin, so one user queueing
+// many builds can't starve everyone else. At most MaxConcurrent jobs run at
+// once across all workers, at most MaxConcurrentPerUser per user and at most
+// one per app, so an app's builds always run in the order they were queued.
+//
+// Dequeued jobs are moved atomically into a per-worker processing list and
+// stay there until they are acked, so a job is never lost if its worker
+// dies mid-build.
+type BuildQueue struct {
+	redis  *redis.Client
+	name   string
+	limits config.Build
+}
+
+func NewBuildQueue(redis *redis.Client, limits config.Build) *BuildQueue {
+	return &BuildQueue{
+		redis:  redis,
+		name:   buildQueueName,
+		limits: limits,
+	}
+}
+
+// Enqueue pushes a job onto its user's queue
+func (q *BuildQueue) Enqueue(ctx context.Context, job *model.BuildJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	userID := job.UserId.Hex()
+	return enqueueScript.Run(ctx, q.redis, []string{q.userQueueKey(userID), q.usersKey()}, data, userID).Err()
+}
+
+// Dequeue takes the next job a slot is free for and moves it into the
+// worker's processing list. It returns nil if there is nothing to run. The
+// raw payload must be passed back to Ack once the job is done.
+func (q *BuildQueue) Dequeue(ctx context.Context, workerID string) (*model.BuildJob, string, error) {
+	keys := []string{q.usersKey(), q.runningKey(), q.processingKey(workerID), q.appsKey()}
+	payload, err := dequeueScript.Run(ctx, q.redis, keys, q.userQueueKey(""), q.limits.MaxConcurrent, q.limits.MaxConcurrentPerUser).Text()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, "", nil // No jobs available
+		}
+		return nil, "", err
+	}
+
+	var job model.BuildJob
+	if err := json.Unmarshal([]byte(payload), &job); err != nil {
+		// Drop payloads we can never process so they don't get redelivered
+		// forever, freeing the slot and app the dequeue claimed for them
+		ackKeys := []string{q.processingKey(workerID), q.runningKey(), q.appsKey()}
+		ackScript.Run(ctx, q.redis, ackKeys, payload, "", "")
+		return nil, "", fmt.Errorf("failed to unmarshal job: %v", err)
+	}
+
+	return &job, payload, nil
+}
+
+// Ack removes a finished job from the worker's processing list and frees
+// the slot it held
+func (q *BuildQueue) Ack(ctx context.Context, workerID string, job *model.BuildJob, payload string) error {
+	keys := []string{q.processingKey(workerID), q.runningKey(), q.appsKey()}
+	return ackScript.Run(ctx, q.redis, keys, payload, job.UserId.Hex(), job.AppId.Hex()).Err()
+}
+
+// Remove deletes the pending job for a deployment from the user's queue. It
+// reports false if the job is no longer pending, e.g. because a worker has
+// already picked it up.
+func (q *BuildQueue) Remove(ctx context.Context, userID, deploymentID string) (bool, error) {
+	payloads, err := q.redis.LRange(ctx, q.userQueueKey(userID), 0, -1).Result()
+	if err != nil {
+		return false, err
+	}
+
+	for _, payload := range payloads {
+		var job model.BuildJob
+		if err := json.Unmarshal([]byte(payload), &job); err != nil {
+			continue
+		}
+		if job.DeploymentId.Hex() != deploymentID {
+			continue
+		}
+
+		keys := []string{q.userQueueKey(userID), q.usersKey()}
+		removed, err := removeScript.Run(ctx, q.redis, keys, payload, userID).Int()
+		if err != nil {
+			return false, err
+		}
+		return removed > 0, nil
+	}
+
+	return false, nil
+}
+
+// Pending returns every queued job in the order they are expected to run.
+// The order follows the round-robin rotation and ignores concurrency caps,
+// so it is an estimate when a user is at their cap.
+func (q *BuildQueue) Pending(ctx context.Context) ([]*model.BuildJob, error) {
+	users, err := q.redis.LRange(ctx, q.usersKey(), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	queues := make([][]*model.BuildJob, 0, len(users))
+	for _, userID := range users {
+		payloads, err := q.redis.LRange(ctx, q.userQueueKey(userID), 0, -1).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		// Jobs are pushed on the left and taken from the right
+		jobs := make([]*model.BuildJob, 0, len(payloads))
+		for i := len(payloads) - 1; i >= 0; i-- {
+			var job model.BuildJob
+			if err := json.Unmarshal([]byte(payloads[i]), &job); err == nil {
+				jobs = append(jobs, &job)
+			}
+		}
+		queues = append(queues, jobs)
+	}
+
+	pending := []*model.BuildJob{}
+	for round := 0; ; round++ {
+		taken := false
+		for _, jobs := range queues {
+			if round < len(jobs) {
+				pending = append(pending, jobs[round])
+				taken = true
+			}
+		}
+		if !taken {
+			break
+		}
+	}
+
+	return pending, nil
+}
+
+// Position returns the 1-based position of a deployment's job among the
+// pending jobs, or 0 if it is not queued
+func (q *BuildQueue) Position(ctx context.Context, deploymentID string) (int, error) {
+	pending, err := q.Pending(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, job := range pending {
+		if job.DeploymentId.Hex() == deploymentID {
+			return i + 1, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// PublishCancellation asks the worker running a deployment's build to stop it
+func (q *BuildQueue) PublishCancellation(ctx context.Context, deploymentID string) error {
+	return q.redis.Publish(ctx, buildCancellationsChannel, deploymentID).Err()
+}
+
+// Cancellations streams the deployment IDs of builds to stop until ctx is done
+func (q *BuildQueue) Cancellations(ctx context.Context) <-chan string {
+	pubsub := q.redis.Subscribe(ctx, buildCancellationsChannel)
+	messages := pubsub.Channel()
+	deploymentIDs := make(chan string)
+
+	go func() {
+		defer close(deploymentIDs)
+		defer pubsub.Close()
+
+		for {
+			select {
+			case message, ok := <-messages:
+				if !ok {
+					return
+				}
+				deploymentIDs <- message.Payload
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return deploymentIDs
+}
+
+// Heartbeat marks the worker as alive
+func (q *BuildQueue) Heartbeat(ctx context.Context, workerID string) error {
+	pipe := q.redis.TxPipeline()
+	pipe.SAdd(ctx, q.workersKey(), workerID)
+	pipe.Set(ctx, q.heartbeatKey(workerID), time.Now().Unix(), workerHeartbeatTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// RequeueOrphans moves the in-flight jobs of every worker whose heartbeat
+// has expired back to the front of the queue and returns how many were moved
+func (q *BuildQueue) RequeueOrphans(ctx context.Context) (int, error) {
+	workerIDs, err := q.redis.SMembers(ctx, q.workersKey()).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	requeued := 0
+	for _, workerID := range workerIDs {
+		alive, err := q.redis.Exists(ctx, q.heartbeatKey(workerID)).Result()
+		if err != nil {
+			return requeued, err
+		}
+		if alive > 0 {
+			continue
+		}
+
+		keys := []string{q.processingKey(workerID), q.usersKey(), q.runningKey(), q.appsKey()}
+		count, err := requeueScript.Run(ctx, q.redis, keys, q.userQueueKey("")).Int()
+		if err != nil {
+			return requeued, err
+		}
+		requeued += count
+
+		q.redis.SRem(ctx, q.workersKey(), workerID)
+	}
+
+	return requeued, nil
+}
+
+func (q *BuildQueue) userQueueKey(userID string) string {
+	return fmt.Sprintf("%s:user:%s", q.name, userID)
+}
+
+func (q *BuildQueue) usersKey() string {
+	return q.name + ":users"
+}
+
+func (q *BuildQueue) runningKey() string {
+	return q.name + ":running"
+}
+
+// appsKey holds the IDs of apps with a build in progress
+func (q *BuildQueue) appsKey() string {
+	return q.name + ":apps"
+}
+
+func (q *BuildQueue) processingKey(workerID string) string {
+	return fmt.Sprintf("%s:processing:%s", q.name, workerID)
+}
+
+func (q *BuildQueue) heartbeatKey(workerID string) string {
+	return fmt.Sprintf("%s:heartbeat:%s", q.name, workerID)
+}
+
+func (q *BuildQueue) workersKey() string {
+	return q.name + ":workers"
+}
@@ -4,33 +4,65 @@ import (
 	"breezy/config"
 	"breezy/model"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strings"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
+// sourceDir is where the repository is cloned inside a build workspace. The
+// rest of the workspace holds the build's HOME and pub cache.
+const sourceDir = "src"
+
 type BuildService struct {
 	db        *mongo.Database
 	config    *config.Environment
 	wsService *WebSocketService
+	queue     *BuildQueue
+	executor  BuildExecutor
+	artifacts ArtifactStore
+	github    *GitHubService
 	buildDir  string
+
+	// flutterSDKs picks the Flutter SDK each Flutter build runs with
+	flutterSDKs *FlutterSDKManager
+	// dependencyCache keeps dependencies between builds, nil if disabled
+	dependencyCache *DependencyCache
+	// mirrors keeps repository mirrors to clone from, nil if disabled
+	mirrors *RepositoryMirrors
+
+	// running holds the cancel funcs of the builds running on this worker,
+	// keyed by deployment ID
+	running map[string]context.CancelFunc
+	mutex   sync.Mutex
+
+	// commitStatuses queues the commit statuses to report to GitHub,
+	// created with its reporter on first use
+	commitStatuses     chan commitStatusReport
+	commitStatusesOnce sync.Once
 }
 
-type PubspecYaml struct {
-	Name        string `yaml:"name" json:"name"`
-	Description string `yaml:"description" json:"description"`
-	Version     string `yaml:"version" json:"version"`
-	Homepage    string `yaml:"homepage" json:"homepage"`
-	Author      string `yaml:"author" json:"author"`
+// activeDeploymentStatuses are the statuses of a deployment whose build is
+// queued or running
+var activeDeploymentStatuses = []model.DeploymentStatus{
+	model.DeploymentStatusPending,
+	model.DeploymentStatusBuilding,
+}
+
+// stoppedDeploymentStatuses are the statuses of a deployment whose build was
+// stopped before it finished
+var stoppedDeploymentStatuses = []model.DeploymentStatus{
+	model.DeploymentStatusCancelled,
+	model.DeploymentStatusSuperseded,
 }
 
 type BuildResult struct {
@@ -42,212 +74,568 @@ type BuildResult struct {
 	OutputSize int64  `json:"outputSize"`
 }
 
-func NewBuildService(db *mongo.Database, config *config.Environment, wsService *WebSocketService) *BuildService {
+func NewBuildService(db *mongo.Database, config *config.Environment, wsService *WebSocketService, queue *BuildQueue, executor BuildExecutor, artifacts ArtifactStore) *BuildService {
 	buildDir := "./builds"
 	if err := os.MkdirAll(buildDir, 0755); err != nil {
 		logrus.WithError(err).Error("Failed to create build directory")
 	}
 
 	return &BuildService{
-		db:        db,
-		config:    config,
-		wsService: wsService,
-		buildDir:  buildDir,
+		db:              db,
+		config:          config,
+		wsService:       wsService,
+		queue:           queue,
+		executor:        executor,
+		artifacts:       artifacts,
+		github:          NewGitHubService(config, db),
+		flutterSDKs:     NewFlutterSDKManager(executor),
+		dependencyCache: NewDependencyCache(config.Build.CacheDir, config.Build.CacheMaxSize),
+		mirrors:         NewRepositoryMirrors(config.Build.MirrorDir, config.Build.MirrorMaxAge, executor),
+		buildDir:        buildDir,
+		running:         make(map[string]context.CancelFunc),
 	}
 }
 
-func (bs *BuildService) StartBuild(appID string, userID string, repoURL string, branch string) {
-	go bs.buildApp(appID, userID, repoURL, branch)
+// BuildOptions change how a single build runs
+type BuildOptions struct {
+	// CommitSha builds that commit instead of the tip of the branch
+	CommitSha string
+	// NoCache clears the app's dependency cache before building
+	NoCache bool
+	// PullRequest builds a preview of the pull request, which doesn't go
+	// live
+	PullRequest int
+	// CommitMessage is recorded as the message of CommitSha, which is
+	// otherwise read from the repository once cloned
+	CommitMessage string
 }
 
-func (bs *BuildService) buildApp(appID string, userID string, repoURL string, branch string) {
-	startTime := time.Now()
-	buildID := primitive.NewObjectID().Hex()
-	buildPath := filepath.Join(bs.buildDir, buildID)
+// EnqueueBuild creates a pending deployment for the app and pushes a build
+// job for it onto the queue. The build itself is run by the worker.
+func (bs *BuildService) EnqueueBuild(appID string, userID string, repoURL string, branch string, options BuildOptions) (*model.BuildJob, error) {
+	appObjectID, err := primitive.ObjectIDFromHex(appID)
+	if err != nil {
+		return nil, err
+	}
+
+	userObjectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	deploymentID, err := bs.createDeploymentRecord(appID, branch, options, model.DeploymentStatusPending)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create deployment record: %v", err)
+	}
+
+	job := &model.BuildJob{
+		Id:            uuid.New().String(),
+		AppId:         appObjectID,
+		UserId:        userObjectID,
+		RepoURL:       repoURL,
+		Branch:        branch,
+		CommitHash:    options.CommitSha,
+		DeploymentId:  deploymentID,
+		NoCache:       options.NoCache,
+		CommitMessage: options.CommitMessage,
+		PullRequest:   options.PullRequest,
+		CreatedAt:     time.Now(),
+	}
+
+	if err := bs.queue.Enqueue(context.Background(), job); err != nil {
+		bs.updateDeploymentStatus(deploymentID, model.DeploymentStatusFailed, &model.DeploymentFailure{
+			Reason:  model.FailureReasonError,
+			Message: "Failed to queue build",
+		})
+		return nil, fmt.Errorf("failed to queue build: %v", err)
+	}
+
+	// Only the latest request for a branch is built
+	bs.supersedeBuilds(appObjectID, userObjectID, branch, options.PullRequest, deploymentID)
+
+	bs.BroadcastQueuePositions()
+	return job, nil
+}
+
+// QueuePosition returns the 1-based queue position of a deployment's build,
+// or 0 if it is not waiting in the queue
+func (bs *BuildService) QueuePosition(deploymentID primitive.ObjectID) (int, error) {
+	return bs.queue.Position(context.Background(), deploymentID.Hex())
+}
+
+// BroadcastQueuePositions tells the owner of every queued build where it
+// now stands in the queue. Positions shift whenever a build is queued,
+// started or cancelled.
+func (bs *BuildService) BroadcastQueuePositions() {
+	pending, err := bs.queue.Pending(context.Background())
+	if err != nil {
+		logrus.WithError(err).Error("Failed to read build queue")
+		return
+	}
+
+	for i, job := range pending {
+		position := i + 1
+		bs.wsService.BroadcastUpdate(BuildUpdate{
+			Type:          "build_update",
+			AppID:         job.AppId.Hex(),
+			UserID:        job.UserId.Hex(),
+			DeploymentID:  job.DeploymentId.Hex(),
+			Status:        "pending",
+			Message:       fmt.Sprintf("Build queued (position %d)", position),
+			QueuePosition: position,
+			Timestamp:     time.Now(),
+		})
+	}
+}
+
+// RunJob runs a queued build job: clone, dependencies, build, upload and
+// promote. Jobs are delivered at least once, so a job whose deployment has
+// already finished is skipped.
+func (bs *BuildService) RunJob(job *model.BuildJob) error {
+	deployment, err := bs.getDeployment(job.DeploymentId)
+	if err != nil {
+		return fmt.Errorf("failed to load deployment: %v", err)
+	}
 
-	// Create deployment record
-	deploymentID, err := bs.createDeploymentRecord(appID, userID, "pending")
+	if deployment.Status != model.DeploymentStatusPending && deployment.Status != model.DeploymentStatusBuilding {
+		logrus.WithField("job_id", job.Id).Infof("Deployment %s already %s, skipping", job.DeploymentId.Hex(), deployment.Status)
+		return nil
+	}
+
+	app, err := bs.getApp(job.AppId)
 	if err != nil {
-		bs.sendUpdate(userID, appID, "failed", "Failed to create deployment record", 0)
+		return fmt.Errorf("failed to load app: %v", err)
+	}
+
+	bs.buildApp(job, app)
+	return nil
+}
+
+func (bs *BuildService) buildApp(job *model.BuildJob, app *model.App) {
+	startTime := time.Now()
+	appID := job.AppId.Hex()
+	userID := job.UserId.Hex()
+	deploymentID := job.DeploymentId
+	buildPath := filepath.Join(bs.buildDir, deploymentID.Hex())
+	logs := bs.newBuildLog(userID, appID, deploymentID)
+	timeouts := bs.buildTimeouts(app)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeouts.Total)
+	defer cancel()
+	bs.trackBuild(deploymentID, cancel)
+	defer bs.untrackBuild(deploymentID)
+
+	// The build may have been cancelled between being dequeued and being
+	// tracked, in which case the cancellation was missed
+	started, err := bs.transitionDeployment(deploymentID, activeDeploymentStatuses, model.DeploymentStatusBuilding, "")
+	if err != nil || !started {
 		return
 	}
 
+	// A redelivered job may find the workspace of a crashed attempt
+	os.RemoveAll(buildPath)
 	defer func() {
 		// Cleanup build directory
 		os.RemoveAll(buildPath)
 	}()
+	if err := os.MkdirAll(buildPath, 0755); err != nil {
+		bs.failBuild(ctx, logs, "clone", "Failed to create build workspace", err)
+		return
+	}
 
 	// Send initial update
-	bs.sendUpdate(userID, appID, "pending", "Build started", 0)
+	bs.sendUpdate(userID, appID, deploymentID, "building", "Build started", 0)
 
 	// Step 1: Clone repository
-	bs.sendUpdate(userID, appID, "cloning", "Cloning repository...", 10)
-	if err := bs.cloneRepository(repoURL, branch, buildPath); err != nil {
-		bs.sendUpdate(userID, appID, "failed", fmt.Sprintf("Failed to clone repository: %v", err), 0)
-		bs.updateDeploymentStatus(deploymentID, "failed", err.Error())
+	bs.startStep(logs, "clone", "cloning", "Cloning repository...", 10)
+	credentials, err := bs.gitCredentials(app)
+	if err != nil {
+		bs.failBuild(ctx, logs, "clone", "Failed to clone repository", err)
 		return
 	}
-
-	// Step 2: Parse pubspec.yaml
-	bs.sendUpdate(userID, appID, "building", "Parsing project configuration...", 30)
-	pubspec, err := bs.parsePubspecYaml(buildPath)
+	source := GitSource{
+		RepoURL:     job.RepoURL,
+		Branch:      job.Branch,
+		Commit:      job.CommitHash,
+		Credentials: credentials,
+	}
+	var commit *GitCommit
+	err = runStep(ctx, timeouts, "clone", timeouts.Clone, func(ctx context.Context) error {
+		var cloneErr error
+		commit, cloneErr = bs.cloneRepository(ctx, source, buildPath, logs.Writer("clone"))
+		return cloneErr
+	})
 	if err != nil {
-		bs.sendUpdate(userID, appID, "failed", fmt.Sprintf("Failed to parse pubspec.yaml: %v", err), 0)
-		bs.updateDeploymentStatus(deploymentID, "failed", err.Error())
+		bs.failBuild(ctx, logs, "clone", "Failed to clone repository", err)
 		return
 	}
+	logs.Printf("clone", "Building commit %s: %s (%s)", shortHash(commit.Hash), commit.Subject, commit.AuthorName)
+	commitFields := bson.M{
+		"gitCommitHash":        commit.Hash,
+		"gitCommitAuthor":      commit.AuthorName,
+		"gitCommitAuthorEmail": commit.AuthorEmail,
+		"gitCommittedAt":       commit.CommittedAt,
+	}
+	// A message known up front is the whole message, not just its subject
+	if job.CommitMessage == "" {
+		commitFields["gitCommitMessage"] = commit.Subject
+	}
+	bs.setDeploymentFields(deploymentID, commitFields)
+	bs.reportCommitStatus(deploymentID, commitStatePending, fmt.Sprintf("Building %s", app.Name))
 
-	// Step 3: Get Flutter dependencies
-	bs.sendUpdate(userID, appID, "building", "Getting Flutter dependencies...", 50)
-	if err := bs.getFlutterDependencies(buildPath); err != nil {
-		bs.sendUpdate(userID, appID, "failed", fmt.Sprintf("Failed to get dependencies: %v", err), 0)
-		bs.updateDeploymentStatus(deploymentID, "failed", err.Error())
+	// Step 2: Read the build configuration and pick a builder
+	bs.startStep(logs, "configure", "building", "Parsing project configuration...", 30)
+	builder, project, err := bs.configureProject(ctx, buildPath, app, logs)
+	if err != nil {
+		bs.failBuild(ctx, logs, "configure", "Invalid project configuration", err)
 		return
 	}
 
-	// Step 4: Build Flutter web app
-	bs.sendUpdate(userID, appID, "building", "Building Flutter web app...", 70)
-	_, err = bs.buildFlutterWeb(buildPath)
+	// Step 3: Install dependencies
+	bs.startStep(logs, "dependencies", "building", "Installing dependencies...", 50)
+	project.NoCache = job.NoCache
+	err = runStep(ctx, timeouts, "dependencies", timeouts.Dependencies, func(ctx context.Context) error {
+		output := logs.Writer("dependencies")
+		defer output.Close()
+		return builder.Dependencies(ctx, project, output)
+	})
+	if project.DependencyCache != "" {
+		bs.setDeploymentFields(deploymentID, bson.M{"dependencyCache": project.DependencyCache})
+	}
 	if err != nil {
-		bs.sendUpdate(userID, appID, "failed", fmt.Sprintf("Build failed: %v", err), 0)
-		bs.updateDeploymentStatus(deploymentID, "failed", err.Error())
+		bs.failBuild(ctx, logs, "dependencies", "Failed to get dependencies", err)
 		return
 	}
 
-	// Step 5: Upload to storage (simplified for now)
-	bs.sendUpdate(userID, appID, "building", "Uploading build artifacts...", 90)
-	appURL, err := bs.uploadBuildArtifacts(buildPath, appID)
+	// Step 4: Build the site
+	bs.startStep(logs, "build", "building", fmt.Sprintf("Building %s app...", builder.Name()), 70)
+	err = runStep(ctx, timeouts, "build", timeouts.Build, func(ctx context.Context) error {
+		return bs.buildProject(ctx, builder, project, logs.Writer("build"))
+	})
 	if err != nil {
-		bs.sendUpdate(userID, appID, "failed", fmt.Sprintf("Failed to upload artifacts: %v", err), 0)
-		bs.updateDeploymentStatus(deploymentID, "failed", err.Error())
+		bs.failBuild(ctx, logs, "build", "Build failed", err)
 		return
 	}
 
-	// Step 6: Update app record
-	bs.sendUpdate(userID, appID, "building", "Finalizing deployment...", 95)
-	if err := bs.updateAppRecord(appID, deploymentID, appURL, pubspec); err != nil {
-		bs.sendUpdate(userID, appID, "failed", fmt.Sprintf("Failed to update app record: %v", err), 0)
-		bs.updateDeploymentStatus(deploymentID, "failed", err.Error())
+	// Step 5: Upload the build output to the artifact store
+	bs.startStep(logs, "upload", "building", "Uploading build artifacts...", 90)
+	var upload *artifactUpload
+	err = runStep(ctx, timeouts, "upload", timeouts.Upload, func(ctx context.Context) error {
+		var uploadErr error
+		upload, uploadErr = bs.uploadBuildArtifacts(ctx, project, project.Config.OutputPath(builder, project), appID, deploymentID, logs.Writer("upload"))
+		return uploadErr
+	})
+	if err != nil {
+		bs.failBuild(ctx, logs, "upload", "Failed to upload artifacts", err)
+		return
+	}
+	logs.Printf("upload", "Uploaded %d files (%s) to %s", upload.Files, formatBytes(upload.Size), upload.URL)
+	bs.setDeploymentFields(deploymentID, bson.M{
+		"staticFilesURL": upload.URL,
+		"previewURL":     PreviewURL(bs.config.Domain.AppDomain, deploymentID.Hex(), app.SanitizedName),
+		"artifactPrefix": upload.Prefix,
+		"artifactFiles":  upload.Files,
+		"artifactSize":   upload.Size,
+	})
+
+	// Step 6: Promote the deployment, or publish it as its pull request's
+	// preview. Claiming success first means a build cancelled at the last
+	// moment never goes live.
+	bs.startStep(logs, "promote", "building", "Finalizing deployment...", 95)
+	completed, err := bs.transitionDeployment(deploymentID, []model.DeploymentStatus{model.DeploymentStatusBuilding}, model.DeploymentStatusSuccess, "")
+	if err != nil {
+		bs.failBuild(ctx, logs, "promote", "Failed to update deployment", err)
+		return
+	}
+	if !completed {
+		bs.failBuild(ctx, logs, "promote", "Build stopped", context.Canceled)
+		return
+	}
+	deployment, err := bs.getDeployment(deploymentID)
+	if err == nil && job.PullRequest != 0 {
+		err = bs.publishPreview(app, deployment)
+	} else if err == nil {
+		_, err = bs.promote(deployment, model.PromotionTriggerBuild, nil)
+	}
+	if err != nil {
+		bs.failBuild(ctx, logs, "promote", "Failed to update app record", err)
 		return
 	}
 
 	// Success!
 	buildTime := time.Since(startTime).Milliseconds()
-	bs.sendUpdate(userID, appID, "success", fmt.Sprintf("Build completed successfully in %dms", buildTime), 100)
-	bs.updateDeploymentStatus(deploymentID, "success", "Build completed successfully")
+	message := fmt.Sprintf("Build completed successfully in %dms", buildTime)
+	logs.Printf("promote", "%s", message)
+	logs.Save()
+	bs.sendUpdate(userID, appID, deploymentID, "success", message, 100)
+	if job.PullRequest != 0 {
+		bs.reportCommitStatus(deploymentID, commitStateSuccess, "Preview ready")
+	} else {
+		bs.reportCommitStatus(deploymentID, commitStateSuccess, fmt.Sprintf("Deployed in %s", time.Since(startTime).Round(time.Second)))
+	}
+}
+
+// startStep announces a build step to the user and records it in the log.
+// The log collected so far is saved so it can be read while building.
+func (bs *BuildService) startStep(logs *BuildLog, step, status, message string, progress int) {
+	logs.Printf(step, "==> %s", message)
+	logs.Save()
+	bs.sendUpdate(logs.userID, logs.appID, logs.deploymentID, status, message, progress)
 }
 
-func (bs *BuildService) cloneRepository(repoURL, branch, buildPath string) error {
-	// Get user's GitHub token for private repos
-	// For now, we'll assume public repos or use a service account token
+// failBuild records a failed step and marks the deployment as failed. A
+// step that failed because the build was cancelled or superseded is only
+// logged, as the deployment was already marked when it was stopped.
+func (bs *BuildService) failBuild(ctx context.Context, logs *BuildLog, step, message string, err error) {
+	if errors.Is(ctx.Err(), context.Canceled) || errors.Is(err, context.Canceled) {
+		logs.Printf(step, "Build stopped")
+		logs.Save()
+		return
+	}
 
-	cmd := exec.Command("git", "clone", "--depth", "1", "--branch", branch, repoURL, buildPath)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	failure := &model.DeploymentFailure{
+		Reason:  model.FailureReasonError,
+		Step:    step,
+		Message: err.Error(),
+	}
 
-	// Check if git is available
-	if _, err := exec.LookPath("git"); err != nil {
-		return fmt.Errorf("git is not installed or not in PATH: %v", err)
+	var timeoutErr *BuildTimeoutError
+	var configErr *BuildConfigError
+	var sdkErr *FlutterSDKError
+	var accessErr *RepositoryAccessError
+	if errors.As(err, &timeoutErr) {
+		failure.Reason = model.FailureReasonTimeout
+		failure.TimeoutSeconds = int64(timeoutErr.Timeout.Seconds())
+		message = "Build timed out"
+	} else if errors.As(err, &configErr) {
+		failure.Reason = model.FailureReasonConfig
+	} else if errors.As(err, &sdkErr) {
+		failure.Reason = model.FailureReasonSDK
+	} else if errors.As(err, &accessErr) {
+		failure.Reason = model.FailureReasonAccess
 	}
 
-	return cmd.Run()
+	message = fmt.Sprintf("%s: %v", message, err)
+	logs.Printf(step, "%s", message)
+	logs.Save()
+	bs.sendUpdateWithData(logs.userID, logs.appID, logs.deploymentID, "failed", message, 0, failure)
+	bs.updateDeploymentStatus(logs.deploymentID, model.DeploymentStatusFailed, failure)
+	bs.reportPreviewFailure(logs.deploymentID, message)
+	bs.reportCommitStatus(logs.deploymentID, commitStateFailure, message)
 }
 
-func (bs *BuildService) parsePubspecYaml(buildPath string) (*PubspecYaml, error) {
-	pubspecPath := filepath.Join(buildPath, "pubspec.yaml")
+// cloneRepository checks the source out into the build workspace, with the
+// credentials if the repository is private, and returns the commit it
+// checked out
+func (bs *BuildService) cloneRepository(ctx context.Context, source GitSource, buildPath string, output *BuildLogWriter) (*GitCommit, error) {
+	defer output.Close()
 
-	// Read pubspec.yaml
-	data, err := os.ReadFile(pubspecPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read pubspec.yaml: %v", err)
-	}
-
-	// Simple parsing for now - in production you'd use a proper YAML parser
-	pubspec := &PubspecYaml{}
-
-	lines := strings.Split(string(data), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "name:") {
-			pubspec.Name = strings.TrimSpace(strings.TrimPrefix(line, "name:"))
-		} else if strings.HasPrefix(line, "description:") {
-			pubspec.Description = strings.TrimSpace(strings.TrimPrefix(line, "description:"))
-		} else if strings.HasPrefix(line, "version:") {
-			pubspec.Version = strings.TrimSpace(strings.TrimPrefix(line, "version:"))
-		} else if strings.HasPrefix(line, "homepage:") {
-			pubspec.Homepage = strings.TrimSpace(strings.TrimPrefix(line, "homepage:"))
-		} else if strings.HasPrefix(line, "author:") {
-			pubspec.Author = strings.TrimSpace(strings.TrimPrefix(line, "author:"))
+	// The commit ends up in a refspec
+	if source.Commit != "" && !commitHashPattern.MatchString(source.Commit) {
+		return nil, fmt.Errorf("invalid commit %q", source.Commit)
+	}
+
+	if err := bs.checkoutSource(ctx, source, buildPath, output); err != nil {
+		return nil, err
+	}
+	return readCommit(ctx, bs.executor, buildPath)
+}
+
+func (bs *BuildService) checkoutSource(ctx context.Context, source GitSource, buildPath string, output io.Writer) error {
+	if bs.mirrors != nil {
+		return bs.mirrors.Clone(ctx, source, buildPath, output)
+	}
+
+	env, secretEnv := gitEnv(source.Credentials)
+	cloneOutput := newGitAccessWriter(output)
+	command := BuildCommand{
+		Name:      "clone",
+		Env:       env,
+		SecretEnv: secretEnv,
+		Network:   true,
+		Output:    cloneOutput,
+	}
+
+	var err error
+	if source.Commit != "" {
+		err = checkoutCommit(ctx, bs.executor, buildPath, source.RepoURL, source.Commit, command)
+	} else {
+		command.Workspace = buildPath
+		command.Args = []string{"git", "clone", "--progress", "--depth", "1", "--branch", source.Branch, source.RepoURL, sourceDir}
+		err = bs.executor.Run(ctx, command)
+	}
+	return cloneOutput.check(err, source.RepoURL)
+}
+
+// gitCredentials returns the credentials builds of the app clone with,
+// those of the GitHub App if it is installed on the app's repository or
+// else the owner's GitHub token, nil if there are none
+func (bs *BuildService) gitCredentials(app *model.App) (*GitCredentials, error) {
+	var repository *model.Repository
+	if !app.RepositoryId.IsZero() {
+		repository = &model.Repository{}
+		err := bs.db.Collection("repositories").FindOne(context.Background(), bson.M{"_id": app.RepositoryId}).Decode(repository)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			repository = nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to load the app's repository: %v", err)
 		}
 	}
 
-	return pubspec, nil
+	token, err := bs.github.RepositoryToken(repository, app.UserId)
+	if err != nil || token == "" {
+		return nil, err
+	}
+	return &GitCredentials{Token: token}, nil
 }
 
-func (bs *BuildService) getFlutterDependencies(buildPath string) error {
-	cmd := exec.Command("flutter", "pub", "get")
-	cmd.Dir = buildPath
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// PruneMirrors removes the mirrors of repositories that haven't been built
+// recently
+func (bs *BuildService) PruneMirrors() {
+	if bs.mirrors != nil {
+		bs.mirrors.Prune()
+	}
+}
 
-	return cmd.Run()
+// CleanDependencyCache removes what a crashed worker left in the dependency
+// cache. The worker calls it when it starts.
+func (bs *BuildService) CleanDependencyCache() {
+	if bs.dependencyCache != nil {
+		bs.dependencyCache.RemoveTemp()
+	}
 }
 
-func (bs *BuildService) buildFlutterWeb(buildPath string) (string, error) {
-	cmd := exec.Command("flutter", "build", "web", "--release", "--base-href", "/")
-	cmd.Dir = buildPath
+// configureProject reads the repository's build configuration, picks the
+// builder for the app and lets it inspect the project
+func (bs *BuildService) configureProject(ctx context.Context, buildPath string, app *model.App, logs *BuildLog) (Builder, *BuildProject, error) {
+	sourcePath := filepath.Join(buildPath, sourceDir)
 
-	// Capture output
-	stdout, err := cmd.StdoutPipe()
+	buildConfig, configFile, err := loadBuildConfig(sourcePath)
 	if err != nil {
-		return "", err
+		return nil, nil, err
+	}
+	if configFile != "" {
+		logs.Printf("configure", "Using build configuration from %s", configFile)
 	}
 
-	stderr, err := cmd.StderrPipe()
+	projectPath, err := buildConfig.ProjectPath(sourcePath)
 	if err != nil {
-		return "", err
+		return nil, nil, &BuildConfigError{File: configFile, Problems: []string{err.Error()}}
 	}
 
-	if err := cmd.Start(); err != nil {
-		return "", err
+	builder, err := selectBuilder(app.Framework, projectPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if app.Framework == "" {
+		logs.Printf("configure", "Detected a %s project", builder.Name())
+	} else {
+		logs.Printf("configure", "Building as a %s project", builder.Name())
 	}
+	bs.setDeploymentFields(logs.deploymentID, bson.M{"framework": builder.Name()})
 
-	// Read output
-	stdoutData, _ := io.ReadAll(stdout)
-	stderrData, _ := io.ReadAll(stderr)
+	if err := buildConfig.checkFramework(builder); err != nil {
+		return nil, nil, err
+	}
 
-	if err := cmd.Wait(); err != nil {
-		return string(stderrData), fmt.Errorf("flutter build failed: %v", err)
+	project := &BuildProject{
+		Workspace:       buildPath,
+		Path:            projectPath,
+		Config:          buildConfig,
+		App:             app,
+		executor:        bs.executor,
+		flutterSDKs:     bs.flutterSDKs,
+		dependencyCache: bs.dependencyCache,
+	}
+	output := logs.Writer("configure")
+	info, err := builder.Configure(ctx, project, output)
+	output.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	if project.SDK != nil {
+		logs.Printf("configure", "Using Flutter %s (Dart %s, channel %s) from %s", project.SDK.Version, project.SDK.DartVersion, project.SDK.Channel, project.SDK.Source)
+		bs.setDeploymentFields(logs.deploymentID, bson.M{"sdk": project.SDK})
 	}
+	if info.Name != "" {
+		logs.Printf("configure", "Project %s, version %s", info.Name, info.Version)
+	}
+	bs.setDeploymentFields(logs.deploymentID, bson.M{"project": info})
 
-	return string(stdoutData), nil
+	return builder, project, nil
 }
 
-func (bs *BuildService) uploadBuildArtifacts(buildPath, appID string) (string, error) {
-	// For now, we'll just return a placeholder URL
-	// In production, you'd upload to Cloudflare R2 or similar
-	webDir := filepath.Join(buildPath, "build", "web")
+// buildProject runs the pre-build commands, the builder and the post-build
+// commands. Dependencies are already installed at this point, so they all
+// run without network access.
+func (bs *BuildService) buildProject(ctx context.Context, builder Builder, project *BuildProject, output *BuildLogWriter) error {
+	defer output.Close()
+
+	run := func(stage, command string) error {
+		fmt.Fprintf(output, "$ %s\n", command)
+		err := project.Run(ctx, BuildCommand{
+			Name:       "build",
+			Args:       []string{"sh", "-c", command},
+			Toolchain:  builder.Toolchain(),
+			FlutterSDK: project.FlutterSDK(),
+			Output:     output,
+		})
+		if err != nil {
+			return fmt.Errorf("%s command %q failed: %v", stage, command, err)
+		}
+		return nil
+	}
+
+	for _, command := range project.Config.PreBuild {
+		if err := run("pre-build", command); err != nil {
+			return err
+		}
+	}
+
+	if err := builder.Build(ctx, project, output); err != nil {
+		return err
+	}
 
-	// Check if build output exists
-	if _, err := os.Stat(webDir); os.IsNotExist(err) {
-		return "", fmt.Errorf("build output not found")
+	for _, command := range project.Config.PostBuild {
+		if err := run("post-build", command); err != nil {
+			return err
+		}
 	}
 
-	// For now, return a placeholder URL
-	appURL := fmt.Sprintf("https://%s.breezy.app", appID)
+	return nil
+}
+
+// uploadBuildArtifacts uploads the build output under the deployment's own
+// prefix in the artifact store
+func (bs *BuildService) uploadBuildArtifacts(ctx context.Context, project *BuildProject, outputDir, appID string, deploymentID primitive.ObjectID, output io.Writer) (*artifactUpload, error) {
+	webDir, err := resolveWithin(project.Path, outputDir)
+	if err != nil {
+		return nil, fmt.Errorf("build output not found: %v", err)
+	}
 
-	return appURL, nil
+	// Check if build output exists
+	if info, err := os.Stat(webDir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("build output not found")
+	}
+
+	return uploadArtifacts(ctx, bs.artifacts, webDir, deploymentArtifactPrefix(appID, deploymentID.Hex()), output)
 }
 
-func (bs *BuildService) createDeploymentRecord(appID, userID, status string) (primitive.ObjectID, error) {
+func (bs *BuildService) createDeploymentRecord(appID, branch string, options BuildOptions, status model.DeploymentStatus) (primitive.ObjectID, error) {
 	collection := bs.db.Collection("deployments")
 
+	// A requested commit is recorded up front, the tip of the branch once
+	// it has been cloned
 	deployment := model.Deployment{
-		Id:         primitive.NewObjectID(),
-		AppId:      primitive.ObjectID{},
-		Status:     model.DeploymentStatus(status),
-		CreatedAt:  time.Now(),
-		FinishedAt: nil,
+		Id:               primitive.NewObjectID(),
+		AppId:            primitive.ObjectID{},
+		Branch:           branch,
+		GitCommitHash:    options.CommitSha,
+		GitCommitMessage: options.CommitMessage,
+		PullRequest:      options.PullRequest,
+		Status:           status,
+		CreatedAt:        time.Now(),
+		FinishedAt:       nil,
 	}
 
 	// Parse appID to ObjectID
@@ -265,49 +653,98 @@ func (bs *BuildService) createDeploymentRecord(appID, userID, status string) (pr
 	return deployment.Id, nil
 }
 
-func (bs *BuildService) updateDeploymentStatus(deploymentID primitive.ObjectID, status, message string) {
+func (bs *BuildService) getApp(appID primitive.ObjectID) (*model.App, error) {
+	collection := bs.db.Collection("apps")
+
+	var app model.App
+	if err := collection.FindOne(context.Background(), bson.M{"_id": appID}).Decode(&app); err != nil {
+		return nil, err
+	}
+
+	return &app, nil
+}
+
+func (bs *BuildService) getDeployment(deploymentID primitive.ObjectID) (*model.Deployment, error) {
 	collection := bs.db.Collection("deployments")
 
-	update := bson.M{
-		"$set": bson.M{
-			"status":     model.DeploymentStatus(status),
-			"finishedAt": time.Now(),
-			"message":    message,
-		},
+	var deployment model.Deployment
+	if err := collection.FindOne(context.Background(), bson.M{"_id": deploymentID}).Decode(&deployment); err != nil {
+		return nil, err
 	}
 
-	collection.UpdateOne(context.Background(), bson.M{"_id": deploymentID}, update)
+	return &deployment, nil
 }
 
-func (bs *BuildService) updateAppRecord(appID string, deploymentID primitive.ObjectID, appURL string, pubspec *PubspecYaml) error {
-	collection := bs.db.Collection("apps")
+// transitionDeployment moves a deployment to a new status, but only if it is
+// currently in one of the given statuses. It reports whether it did.
+func (bs *BuildService) transitionDeployment(deploymentID primitive.ObjectID, from []model.DeploymentStatus, to model.DeploymentStatus, errorMessage string) (bool, error) {
+	collection := bs.db.Collection("deployments")
 
-	appObjectID, err := primitive.ObjectIDFromHex(appID)
+	set := bson.M{"status": to}
+	if to != model.DeploymentStatusPending && to != model.DeploymentStatusBuilding {
+		set["finishedAt"] = time.Now()
+	}
+	if errorMessage != "" {
+		set["error"] = errorMessage
+	}
+
+	result, err := collection.UpdateOne(context.Background(), bson.M{
+		"_id":    deploymentID,
+		"status": bson.M{"$in": from},
+	}, bson.M{"$set": set})
 	if err != nil {
-		return err
+		return false, err
+	}
+
+	return result.MatchedCount > 0, nil
+}
+
+// setDeploymentFields records details of a deployment learnt while building
+func (bs *BuildService) setDeploymentFields(deploymentID primitive.ObjectID, set bson.M) {
+	collection := bs.db.Collection("deployments")
+
+	if _, err := collection.UpdateOne(context.Background(), bson.M{"_id": deploymentID}, bson.M{"$set": set}); err != nil {
+		logrus.WithError(err).Errorf("Failed to update deployment %s", deploymentID.Hex())
 	}
+}
+
+func (bs *BuildService) updateDeploymentStatus(deploymentID primitive.ObjectID, status model.DeploymentStatus, failure *model.DeploymentFailure) {
+	collection := bs.db.Collection("deployments")
 
-	update := bson.M{
-		"$set": bson.M{
-			"currentDeploymentId": deploymentID,
-			"staticFilesURL":      appURL,
-			"updatedAt":           time.Now(),
-		},
+	set := bson.M{
+		"status":     status,
+		"finishedAt": time.Now(),
+	}
+	if failure != nil {
+		set["error"] = failure.Message
+		set["failure"] = failure
 	}
 
-	_, err = collection.UpdateOne(context.Background(), bson.M{"_id": appObjectID}, update)
-	return err
+	// Never overwrite a cancellation with the outcome of the stopped build
+	collection.UpdateOne(context.Background(), bson.M{
+		"_id":    deploymentID,
+		"status": bson.M{"$nin": stoppedDeploymentStatuses},
+	}, bson.M{"$set": set})
+}
+
+// sendUpdate announces a change of a build to the app's subscribers. The
+// deployment tells apart builds of one app that run at once, such as a pull
+// request preview and a branch deployment.
+func (bs *BuildService) sendUpdate(userID, appID string, deploymentID primitive.ObjectID, status, message string, progress int) {
+	bs.sendUpdateWithData(userID, appID, deploymentID, status, message, progress, nil)
 }
 
-func (bs *BuildService) sendUpdate(userID, appID, status, message string, progress int) {
+func (bs *BuildService) sendUpdateWithData(userID, appID string, deploymentID primitive.ObjectID, status, message string, progress int, data any) {
 	update := BuildUpdate{
-		Type:      "build_update",
-		AppID:     appID,
-		UserID:    userID,
-		Status:    status,
-		Message:   message,
-		Progress:  progress,
-		Timestamp: time.Now(),
+		Type:         "build_update",
+		AppID:        appID,
+		UserID:       userID,
+		DeploymentID: deploymentID.Hex(),
+		Status:       status,
+		Message:      message,
+		Progress:     progress,
+		Data:         data,
+		Timestamp:    time.Now(),
 	}
 
 	bs.wsService.BroadcastUpdate(update)
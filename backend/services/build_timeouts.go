@@ -0,0 +1,67 @@
+package services
+
+import (
+	"breezy/config"
+	"breezy/model"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// BuildTimeoutError is returned when a build step runs past its own
+// timeout or the build runs past its overall timeout
+type BuildTimeoutError struct {
+	Step    string
+	Timeout time.Duration
+	// Total is set when the overall build timeout fired rather than the
+	// step's own
+	Total bool
+}
+
+func (e *BuildTimeoutError) Error() string {
+	if e.Total {
+		return fmt.Sprintf("build timed out after %s during the %s step", e.Timeout, e.Step)
+	}
+	return fmt.Sprintf("%s step timed out after %s", e.Step, e.Timeout)
+}
+
+// buildTimeouts returns the server's build timeouts with the app's
+// overrides applied
+func (bs *BuildService) buildTimeouts(app *model.App) config.BuildTimeouts {
+	timeouts := bs.config.Build.Timeouts
+	if app == nil || app.BuildTimeouts == nil {
+		return timeouts
+	}
+
+	override := func(current *time.Duration, seconds int) {
+		if seconds > 0 {
+			*current = time.Duration(seconds) * time.Second
+		}
+	}
+	override(&timeouts.Total, app.BuildTimeouts.TotalSeconds)
+	override(&timeouts.Clone, app.BuildTimeouts.CloneSeconds)
+	override(&timeouts.Dependencies, app.BuildTimeouts.DependenciesSeconds)
+	override(&timeouts.Build, app.BuildTimeouts.BuildSeconds)
+	override(&timeouts.Upload, app.BuildTimeouts.UploadSeconds)
+
+	return timeouts
+}
+
+// runStep runs a build step under its timeout. ctx carries the overall
+// build timeout; if either deadline fires the step's error is replaced by a
+// BuildTimeoutError saying which one.
+func runStep(ctx context.Context, timeouts config.BuildTimeouts, step string, timeout time.Duration, fn func(ctx context.Context) error) error {
+	stepCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := fn(stepCtx)
+	if err == nil || !errors.Is(stepCtx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &BuildTimeoutError{Step: step, Timeout: timeouts.Total, Total: true}
+	}
+	return &BuildTimeoutError{Step: step, Timeout: timeout}
+}
@@ -0,0 +1,127 @@
+package services
+
+import (
+	"breezy/model"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Toolchains select the image build commands run in with the docker
+// executor
+const (
+	ToolchainFlutter = "flutter"
+	ToolchainNode    = "node"
+	ToolchainHugo    = "hugo"
+)
+
+// Builder builds one kind of project into a static site. Every builder's
+// output goes through the same upload and promote steps.
+type Builder interface {
+	// Name identifies the builder in app settings and deployments
+	Name() string
+	// Toolchain is the toolchain the builder's commands need
+	Toolchain() string
+	// Detect reports whether the project directory holds a project this
+	// builder can build
+	Detect(projectPath string) bool
+	// Configure inspects the project and its build configuration and
+	// prepares the toolchain before anything is installed. Problems with
+	// the configuration are returned as a BuildConfigError.
+	Configure(ctx context.Context, project *BuildProject, output io.Writer) (*model.ProjectMetadata, error)
+	// Dependencies installs the project's dependencies. It runs with
+	// network access.
+	Dependencies(ctx context.Context, project *BuildProject, output io.Writer) error
+	// Build builds the site. It runs without network access.
+	Build(ctx context.Context, project *BuildProject, output io.Writer) error
+	// OutputDir returns the directory holding the built site, relative to
+	// the project directory, when the build configuration doesn't set one
+	OutputDir(project *BuildProject) string
+}
+
+// builders in the order they are tried when detecting a project.
+// Frameworks that commonly ship a package.json alongside come before Node.
+var builders = []Builder{
+	&FlutterBuilder{},
+	&HugoBuilder{},
+	&NodeBuilder{},
+	&StaticBuilder{},
+}
+
+// BuildProject is a checked out project being built
+type BuildProject struct {
+	// Workspace is the host build workspace
+	Workspace string
+	// Path is the host path of the project directory
+	Path   string
+	Config *BuildConfig
+	App    *model.App
+	// SDK is the SDK picked for the build, if the builder needs one
+	SDK *model.SDKVersion
+	// NoCache has the build clear the app's dependency cache and start
+	// from scratch
+	NoCache bool
+	// DependencyCache is how the dependency cache was used, empty if it
+	// wasn't
+	DependencyCache string
+
+	executor        BuildExecutor
+	flutterSDKs     *FlutterSDKManager
+	dependencyCache *DependencyCache
+}
+
+// Run runs a command in the project directory
+func (p *BuildProject) Run(ctx context.Context, command BuildCommand) error {
+	command.Workspace = p.Workspace
+	command.Dir = p.Config.ProjectDir()
+	return p.executor.Run(ctx, command)
+}
+
+// FlutterSDK returns the Flutter SDK commands should run with, "" for the
+// default
+func (p *BuildProject) FlutterSDK() string {
+	if p.SDK == nil {
+		return ""
+	}
+	return p.SDK.Requested
+}
+
+// HasFile reports whether the project directory contains the file
+func (p *BuildProject) HasFile(name string) bool {
+	return fileExists(filepath.Join(p.Path, name))
+}
+
+// selectBuilder returns the builder for the app's framework, or detects one
+// from the project if the app doesn't set it
+func selectBuilder(framework, projectPath string) (Builder, error) {
+	if framework != "" {
+		for _, builder := range builders {
+			if builder.Name() == framework {
+				return builder, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown framework %q", framework)
+	}
+
+	for _, builder := range builders {
+		if builder.Detect(projectPath) {
+			return builder, nil
+		}
+	}
+
+	return nil, &BuildConfigError{Problems: []string{
+		"could not detect how to build the project; set a framework in the app settings",
+	}}
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+func dirExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
@@ -0,0 +1,176 @@
+package services
+
+import (
+	"breezy/model"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// FlutterBuilder builds Flutter web apps
+type FlutterBuilder struct{}
+
+func (b *FlutterBuilder) Name() string {
+	return model.FrameworkFlutter
+}
+
+func (b *FlutterBuilder) Toolchain() string {
+	return ToolchainFlutter
+}
+
+func (b *FlutterBuilder) Detect(projectPath string) bool {
+	return fileExists(filepath.Join(projectPath, "pubspec.yaml"))
+}
+
+func (b *FlutterBuilder) Configure(ctx context.Context, project *BuildProject, output io.Writer) (*model.ProjectMetadata, error) {
+	problems := []string{}
+	for _, flag := range project.Config.Build.Flags {
+		name := strings.SplitN(flag, "=", 2)[0]
+		switch name {
+		case "--output", "-o", "--base-href", "--web-renderer", "--wasm", "--dart-define":
+			problems = append(problems, fmt.Sprintf("build.flags: %s is set by Breezy, use the matching setting instead", name))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, &BuildConfigError{File: project.Config.file, Problems: problems}
+	}
+
+	pubspec, err := parsePubspecYaml(project.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !dirExists(filepath.Join(project.Path, "web")) {
+		return nil, errors.New("the project has no web support: run `flutter create --platforms web .` in the project and commit the web/ directory")
+	}
+
+	version, source, err := flutterSDKPin(project)
+	if err != nil {
+		return nil, err
+	}
+	project.SDK, err = project.flutterSDKs.Select(ctx, project.Workspace, flutterSDKRequest{
+		Version:           version,
+		Source:            source,
+		SDKConstraint:     pubspec.Environment.SDK,
+		FlutterConstraint: pubspec.Environment.Flutter,
+	}, output)
+	if err != nil {
+		return nil, err
+	}
+
+	return pubspec.Metadata(), nil
+}
+
+func (b *FlutterBuilder) Dependencies(ctx context.Context, project *BuildProject, output io.Writer) error {
+	key := restorePubCache(project, output)
+
+	err := project.Run(ctx, BuildCommand{
+		Name:       "dependencies",
+		Args:       []string{"flutter", "pub", "get"},
+		Network:    true,
+		Toolchain:  b.Toolchain(),
+		FlutterSDK: project.FlutterSDK(),
+		Output:     output,
+	})
+	if err != nil {
+		return err
+	}
+
+	if key != nil {
+		size, err := project.dependencyCache.Store(key, filepath.Join(project.Workspace, pubCacheDir))
+		if err != nil {
+			fmt.Fprintf(output, "Failed to save the dependency cache: %v\n", err)
+		} else if size > 0 {
+			fmt.Fprintf(output, "Saved the dependency cache (%s)\n", formatBytes(size))
+		}
+	}
+	return nil
+}
+
+func (b *FlutterBuilder) Build(ctx context.Context, project *BuildProject, output io.Writer) error {
+	err := project.Run(ctx, BuildCommand{
+		Name:       "build",
+		Args:       flutterBuildArgs(project.Config),
+		Toolchain:  b.Toolchain(),
+		FlutterSDK: project.FlutterSDK(),
+		Output:     output,
+	})
+	if err != nil {
+		return fmt.Errorf("flutter build failed: %v", err)
+	}
+	return nil
+}
+
+func (b *FlutterBuilder) OutputDir(project *BuildProject) string {
+	return "build/web"
+}
+
+// restorePubCache fills the build's pub cache from the dependency cache and
+// returns the key to store it under once the dependencies are installed, or
+// nil if the project can't be cached. Cache problems never fail a build, it
+// just downloads everything.
+func restorePubCache(project *BuildProject, output io.Writer) *DependencyCacheKey {
+	cache := project.dependencyCache
+	if cache == nil {
+		return nil
+	}
+
+	key, err := pubCacheKey(project)
+	if err != nil {
+		fmt.Fprintf(output, "Not using the dependency cache: %v\n", err)
+		return nil
+	}
+	if key == nil {
+		fmt.Fprintln(output, "Not using the dependency cache: the project has no pubspec.lock")
+		return nil
+	}
+
+	if project.NoCache {
+		if err := cache.ClearApp(key.UserID, key.AppID); err != nil {
+			fmt.Fprintf(output, "Failed to clear the dependency cache: %v\n", err)
+		} else {
+			fmt.Fprintln(output, "Cleared the dependency cache of this app")
+		}
+		project.DependencyCache = DependencyCacheCleared
+		return key
+	}
+
+	size, err := cache.Restore(key, filepath.Join(project.Workspace, pubCacheDir))
+	switch {
+	case err != nil:
+		fmt.Fprintf(output, "Failed to restore the dependency cache: %v\n", err)
+		project.DependencyCache = DependencyCacheMiss
+	case size < 0:
+		fmt.Fprintln(output, "No dependency cache for this pubspec.lock and Flutter SDK yet")
+		project.DependencyCache = DependencyCacheMiss
+	default:
+		fmt.Fprintf(output, "Restored the dependency cache (%s)\n", formatBytes(size))
+		project.DependencyCache = DependencyCacheHit
+	}
+	return key
+}
+
+// flutterBuildArgs returns the `flutter build web` command line
+func flutterBuildArgs(config *BuildConfig) []string {
+	args := []string{"flutter", "build", "web", "--release", "--base-href", "/"}
+
+	if config.Build.Wasm {
+		args = append(args, "--wasm")
+	} else if config.Build.Renderer != "" {
+		args = append(args, "--web-renderer", config.Build.Renderer)
+	}
+
+	// Sorted so the same config always produces the same command
+	for _, name := range sortedKeys(config.Build.DartDefines) {
+		args = append(args, fmt.Sprintf("--dart-define=%s=%s", name, config.Build.DartDefines[name]))
+	}
+
+	if config.OutputDir != "" {
+		args = append(args, "--output", filepath.Clean(config.OutputDir))
+	}
+
+	return append(args, config.Build.Flags...)
+}
@@ -0,0 +1,98 @@
+package services
+
+import (
+	"breezy/model"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// hugoConfigFiles are the site configuration files Hugo reads. The config.*
+// names are only taken as a Hugo site together with a Hugo directory.
+var hugoConfigFiles = []string{"hugo.toml", "hugo.yaml", "hugo.yml", "hugo.json"}
+var hugoLegacyConfigFiles = []string{"config.toml", "config.yaml", "config.yml"}
+var hugoDirs = []string{"archetypes", "layouts", "themes"}
+
+// HugoBuilder builds Hugo sites
+type HugoBuilder struct{}
+
+func (b *HugoBuilder) Name() string {
+	return model.FrameworkHugo
+}
+
+func (b *HugoBuilder) Toolchain() string {
+	return ToolchainHugo
+}
+
+func (b *HugoBuilder) Detect(projectPath string) bool {
+	for _, name := range hugoConfigFiles {
+		if fileExists(filepath.Join(projectPath, name)) {
+			return true
+		}
+	}
+
+	for _, name := range hugoLegacyConfigFiles {
+		if !fileExists(filepath.Join(projectPath, name)) {
+			continue
+		}
+		for _, dir := range hugoDirs {
+			if dirExists(filepath.Join(projectPath, dir)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (b *HugoBuilder) Configure(ctx context.Context, project *BuildProject, output io.Writer) (*model.ProjectMetadata, error) {
+	for _, flag := range project.Config.Build.Flags {
+		name := strings.SplitN(flag, "=", 2)[0]
+		if name == "--destination" || name == "-d" {
+			return nil, &BuildConfigError{File: project.Config.file, Problems: []string{
+				fmt.Sprintf("build.flags: %s is set by Breezy, use outputDir instead", name),
+			}}
+		}
+	}
+	return &model.ProjectMetadata{}, nil
+}
+
+// Dependencies fetches Hugo modules for sites that use them
+func (b *HugoBuilder) Dependencies(ctx context.Context, project *BuildProject, output io.Writer) error {
+	if !project.HasFile("go.mod") {
+		fmt.Fprintln(output, "No Hugo modules to fetch")
+		return nil
+	}
+
+	return project.Run(ctx, BuildCommand{
+		Name:      "dependencies",
+		Args:      []string{"hugo", "mod", "get"},
+		Network:   true,
+		Toolchain: b.Toolchain(),
+		Output:    output,
+	})
+}
+
+func (b *HugoBuilder) Build(ctx context.Context, project *BuildProject, output io.Writer) error {
+	args := []string{"hugo", "--minify"}
+	if project.Config.OutputDir != "" {
+		args = append(args, "--destination", filepath.Clean(project.Config.OutputDir))
+	}
+
+	err := project.Run(ctx, BuildCommand{
+		Name:      "build",
+		Args:      append(args, project.Config.Build.Flags...),
+		Toolchain: b.Toolchain(),
+		Output:    output,
+	})
+	if err != nil {
+		return fmt.Errorf("hugo build failed: %v", err)
+	}
+	return nil
+}
+
+func (b *HugoBuilder) OutputDir(project *BuildProject) string {
+	return "public"
+}
@@ -0,0 +1,177 @@
+package services
+
+import (
+	"breezy/model"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// nodeOutputDirs are where common front end tools write their build, in the
+// order they are looked for: Vite, Create React App, Next.js static export
+var nodeOutputDirs = []string{"dist", "build", "out"}
+
+// nodeEnv keeps corepack from prompting before it downloads pnpm or yarn
+var nodeEnv = []string{"COREPACK_ENABLE_DOWNLOAD_PROMPT=0"}
+
+// NodeBuilder builds front ends with the build script in package.json,
+// using npm, pnpm or yarn depending on the lockfile
+type NodeBuilder struct{}
+
+type packageJSON struct {
+	Name            string            `json:"name"`
+	Description     string            `json:"description"`
+	Version         string            `json:"version"`
+	Scripts         map[string]string `json:"scripts"`
+	Dependencies    map[string]string `json:"dependencies"`
+	DevDependencies map[string]string `json:"devDependencies"`
+	// PackageManager pins the package manager, as in "yarn@4.1.0"
+	PackageManager string `json:"packageManager"`
+}
+
+func (b *NodeBuilder) Name() string {
+	return model.FrameworkNode
+}
+
+func (b *NodeBuilder) Toolchain() string {
+	return ToolchainNode
+}
+
+func (b *NodeBuilder) Detect(projectPath string) bool {
+	return fileExists(filepath.Join(projectPath, "package.json"))
+}
+
+func (b *NodeBuilder) Configure(ctx context.Context, project *BuildProject, output io.Writer) (*model.ProjectMetadata, error) {
+	data, err := readProjectFile(project.Path, "package.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read package.json: %v", err)
+	}
+
+	var pkg packageJSON
+	if err := json.Unmarshal(data, &pkg); err != nil {
+		return nil, fmt.Errorf("failed to parse package.json: %v", err)
+	}
+	if pkg.Scripts["build"] == "" {
+		return nil, fmt.Errorf("package.json has no build script")
+	}
+
+	metadata := &model.ProjectMetadata{
+		Name:        pkg.Name,
+		Description: pkg.Description,
+		Version:     pkg.Version,
+	}
+	for _, dependencies := range []struct {
+		packages map[string]string
+		dev      bool
+	}{{pkg.Dependencies, false}, {pkg.DevDependencies, true}} {
+		for _, name := range sortedKeys(dependencies.packages) {
+			metadata.Dependencies = append(metadata.Dependencies, model.ProjectDependency{
+				Name:       name,
+				Constraint: dependencies.packages[name],
+				Source:     "npm",
+				Dev:        dependencies.dev,
+			})
+		}
+	}
+
+	return metadata, nil
+}
+
+func (b *NodeBuilder) Dependencies(ctx context.Context, project *BuildProject, output io.Writer) error {
+	var args []string
+	switch packageManager(project) {
+	case "pnpm":
+		args = []string{"corepack", "pnpm", "install", "--frozen-lockfile"}
+	case "yarn":
+		args = []string{"corepack", "yarn", "install", "--frozen-lockfile"}
+		if yarnBerry(project) {
+			args = []string{"corepack", "yarn", "install", "--immutable"}
+		}
+	default:
+		args = []string{"npm", "install"}
+		if project.HasFile("package-lock.json") {
+			args = []string{"npm", "ci"}
+		}
+	}
+
+	return project.Run(ctx, BuildCommand{
+		Name:      "dependencies",
+		Args:      args,
+		Env:       nodeEnv,
+		Network:   true,
+		Toolchain: b.Toolchain(),
+		Output:    output,
+	})
+}
+
+func (b *NodeBuilder) Build(ctx context.Context, project *BuildProject, output io.Writer) error {
+	args := []string{"npm", "run", "build"}
+	if manager := packageManager(project); manager != "npm" {
+		args = []string{"corepack", manager, "run", "build"}
+	}
+	if flags := project.Config.Build.Flags; len(flags) > 0 {
+		args = append(append(args, "--"), flags...)
+	}
+
+	err := project.Run(ctx, BuildCommand{
+		Name:      "build",
+		Args:      args,
+		Env:       nodeEnv,
+		Toolchain: b.Toolchain(),
+		Output:    output,
+	})
+	if err != nil {
+		return fmt.Errorf("build script failed: %v", err)
+	}
+	return nil
+}
+
+func (b *NodeBuilder) OutputDir(project *BuildProject) string {
+	for _, dir := range nodeOutputDirs {
+		if dirExists(filepath.Join(project.Path, dir)) {
+			return dir
+		}
+	}
+	return nodeOutputDirs[0]
+}
+
+// packageManager picks the package manager the project's lockfile is for
+func packageManager(project *BuildProject) string {
+	switch {
+	case project.HasFile("pnpm-lock.yaml"):
+		return "pnpm"
+	case project.HasFile("yarn.lock"):
+		return "yarn"
+	default:
+		return "npm"
+	}
+}
+
+// yarnBerry reports whether a yarn project uses yarn 2 or later, which
+// replaced --frozen-lockfile with --immutable. Those projects have a
+// .yarnrc.yml, or pin the version in package.json.
+func yarnBerry(project *BuildProject) bool {
+	if project.HasFile(".yarnrc.yml") {
+		return true
+	}
+
+	data, err := readProjectFile(project.Path, "package.json")
+	if err != nil {
+		return false
+	}
+	var pkg packageJSON
+	if err := json.Unmarshal(data, &pkg); err != nil {
+		return false
+	}
+	version, ok := strings.CutPrefix(pkg.PackageManager, "yarn@")
+	if !ok {
+		return false
+	}
+	major, _, _ := strings.Cut(version, ".")
+	n, err := strconv.Atoi(major)
+	return err == nil && n >= 2
+}
@@ -0,0 +1,47 @@
+package services
+
+import (
+	"breezy/model"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// StaticBuilder publishes a site of plain HTML files as it is committed
+type StaticBuilder struct{}
+
+func (b *StaticBuilder) Name() string {
+	return model.FrameworkStatic
+}
+
+func (b *StaticBuilder) Toolchain() string {
+	return ""
+}
+
+func (b *StaticBuilder) Detect(projectPath string) bool {
+	return fileExists(filepath.Join(projectPath, "index.html"))
+}
+
+func (b *StaticBuilder) Configure(ctx context.Context, project *BuildProject, output io.Writer) (*model.ProjectMetadata, error) {
+	if len(project.Config.Build.Flags) > 0 {
+		return nil, &BuildConfigError{File: project.Config.file, Problems: []string{
+			"build.flags: static sites have no build command to pass flags to",
+		}}
+	}
+	return &model.ProjectMetadata{}, nil
+}
+
+func (b *StaticBuilder) Dependencies(ctx context.Context, project *BuildProject, output io.Writer) error {
+	fmt.Fprintln(output, "Static site, no dependencies to install")
+	return nil
+}
+
+func (b *StaticBuilder) Build(ctx context.Context, project *BuildProject, output io.Writer) error {
+	fmt.Fprintln(output, "Static site, nothing to build")
+	return nil
+}
+
+func (b *StaticBuilder) OutputDir(project *BuildProject) string {
+	return "."
+}
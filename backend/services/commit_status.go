@@ -0,0 +1,145 @@
+package services
+
+import (
+	"breezy/model"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Commit status states
+const (
+	commitStatePending = "pending"
+	commitStateSuccess = "success"
+	commitStateFailure = "failure"
+	commitStateError   = "error"
+)
+
+// commitStatusTimeout bounds reporting a single commit status
+const commitStatusTimeout = 30 * time.Second
+
+// commitStatusBacklog is how many commit statuses may wait to be reported
+// before new ones are dropped
+const commitStatusBacklog = 256
+
+// commitStatusReport is a commit status waiting to be reported
+type commitStatusReport struct {
+	deploymentID primitive.ObjectID
+	state        string
+	description  string
+}
+
+// maxCommitStatusDescription is the longest description GitHub accepts, in
+// characters
+const maxCommitStatusDescription = 140
+
+// reportCommitStatus sets the status of the commit a deployment builds on
+// GitHub, as the GitHub App or the app owner. Statuses are posted in the
+// background, one at a time and in order, so a slow or unreachable GitHub
+// never delays a build; failing to report is logged and never fails it.
+func (bs *BuildService) reportCommitStatus(deploymentID primitive.ObjectID, state, description string) {
+	bs.commitStatusesOnce.Do(func() {
+		bs.commitStatuses = make(chan commitStatusReport, commitStatusBacklog)
+		go bs.reportCommitStatuses()
+	})
+
+	select {
+	case bs.commitStatuses <- commitStatusReport{deploymentID: deploymentID, state: state, description: description}:
+	default:
+		logrus.Warnf("Dropped the %s commit status of deployment %s: too many statuses waiting to be reported", state, deploymentID.Hex())
+	}
+}
+
+// reportCommitStatuses posts the queued commit statuses until the process
+// exits
+func (bs *BuildService) reportCommitStatuses() {
+	for report := range bs.commitStatuses {
+		ctx, cancel := context.WithTimeout(context.Background(), commitStatusTimeout)
+		bs.sendCommitStatus(ctx, report)
+		cancel()
+	}
+}
+
+// sendCommitStatus posts one commit status, giving up when ctx is done
+func (bs *BuildService) sendCommitStatus(ctx context.Context, report commitStatusReport) {
+	deployment, err := bs.getDeployment(report.deploymentID)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to load deployment %s", report.deploymentID.Hex())
+		return
+	}
+	// Manual deployments only know their commit once it is cloned
+	if deployment.GitCommitHash == "" {
+		return
+	}
+
+	app, err := bs.getApp(deployment.AppId)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to load app %s", deployment.AppId.Hex())
+		return
+	}
+	if app.RepositoryId.IsZero() {
+		return
+	}
+
+	var repository model.Repository
+	err = bs.db.Collection("repositories").FindOne(ctx, bson.M{"_id": app.RepositoryId}).Decode(&repository)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to load the repository of app %s", app.Id.Hex())
+		return
+	}
+
+	token, err := bs.github.RepositoryToken(&repository, app.UserId)
+	if err != nil || token == "" {
+		return
+	}
+	bs.postCommitStatus(ctx, token, &repository, app, deployment, report.state, report.description)
+}
+
+// postCommitStatus sets the status of a deployment's commit with token,
+// logging a failure
+func (bs *BuildService) postCommitStatus(ctx context.Context, token string, repository *model.Repository, app *model.App, deployment *model.Deployment, state, description string) {
+	status := CommitStatus{
+		State:       state,
+		TargetURL:   bs.commitStatusTargetURL(app, deployment, state),
+		Description: truncateDescription(description),
+		Context:     commitStatusContext(app, deployment),
+	}
+	if err := bs.github.CreateCommitStatus(ctx, token, repository.FullName, deployment.GitCommitHash, status); err != nil {
+		logrus.WithError(err).Warnf("Failed to report the status of %s@%s for deployment %s",
+			repository.FullName, shortHash(deployment.GitCommitHash), deployment.Id.Hex())
+	}
+}
+
+// commitStatusContext names the statuses of an app's builds, which tells
+// them apart from those of other apps built from the same repository
+func commitStatusContext(app *model.App, deployment *model.Deployment) string {
+	if deployment.PullRequest != 0 {
+		return "breezy/" + app.SanitizedName + "/preview"
+	}
+	return "breezy/" + app.SanitizedName
+}
+
+// commitStatusTargetURL links a successful deployment to its preview URL,
+// and any other to its build logs on the dashboard
+func (bs *BuildService) commitStatusTargetURL(app *model.App, deployment *model.Deployment, state string) string {
+	if state == commitStateSuccess && deployment.PreviewURL != "" {
+		return deployment.PreviewURL
+	}
+	if bs.config.Domain.FrontendURL == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/projects/%s?deployment=%s", strings.TrimSuffix(bs.config.Domain.FrontendURL, "/"), app.Id.Hex(), deployment.Id.Hex())
+}
+
+func truncateDescription(description string) string {
+	runes := []rune(description)
+	if len(runes) <= maxCommitStatusDescription {
+		return description
+	}
+	return string(runes[:maxCommitStatusDescription-1]) + "…"
+}
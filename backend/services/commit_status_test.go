@@ -0,0 +1,201 @@
+package services
+
+import (
+	"breezy/config"
+	"breezy/model"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// fakeStatusServer records the commit statuses posted to a fake GitHub
+// API, answering each with the next of its codes, then 201
+type fakeStatusServer struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	codes    []int
+	paths    []string
+	auth     []string
+	statuses []CommitStatus
+}
+
+func newFakeStatusServer(t *testing.T, codes ...int) *fakeStatusServer {
+	fake := &fakeStatusServer{codes: codes}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var status CommitStatus
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&status) != nil {
+			http.Error(w, `{"message":"Bad Request"}`, http.StatusBadRequest)
+			return
+		}
+
+		fake.mutex.Lock()
+		defer fake.mutex.Unlock()
+		fake.paths = append(fake.paths, r.URL.Path)
+		fake.auth = append(fake.auth, r.Header.Get("Authorization"))
+		fake.statuses = append(fake.statuses, status)
+
+		code := http.StatusCreated
+		if len(fake.codes) > 0 {
+			code, fake.codes = fake.codes[0], fake.codes[1:]
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if code >= 400 {
+			w.Write([]byte(`{"message":"Server Error"}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+func newCommitStatusBuildService(apiURL, frontendURL string) *BuildService {
+	env := &config.Environment{
+		Domain: config.Domain{AppDomain: "breezy.app", FrontendURL: frontendURL},
+		GitHub: config.GitHub{APIURL: apiURL},
+	}
+	return &BuildService{config: env, github: &GitHubService{config: env}}
+}
+
+func TestPostCommitStatus(t *testing.T) {
+	app := &model.App{Id: primitive.NewObjectID(), Name: "My App", SanitizedName: "my-app"}
+	repository := &model.Repository{FullName: "octo/site"}
+	sha := "9fceb02d0ae598e95dc970b74767f19372d61af8"
+	logsURL := func(deployment *model.Deployment) string {
+		return "https://dashboard.example.com/projects/" + app.Id.Hex() + "?deployment=" + deployment.Id.Hex()
+	}
+
+	branch := &model.Deployment{Id: primitive.NewObjectID(), AppId: app.Id, GitCommitHash: sha}
+	preview := &model.Deployment{Id: primitive.NewObjectID(), AppId: app.Id, GitCommitHash: sha, PullRequest: 7}
+
+	type report struct {
+		deployment  *model.Deployment
+		state       string
+		description string
+		// previewURL is set on the deployment before reporting, as the
+		// upload does
+		previewURL string
+	}
+	tests := []struct {
+		name        string
+		frontendURL string
+		codes       []int
+		reports     []report
+		want        []CommitStatus
+	}{
+		{
+			name:        "success links the preview",
+			frontendURL: "https://dashboard.example.com/",
+			reports: []report{
+				{deployment: branch, state: commitStatePending, description: "Building My App"},
+				{deployment: branch, state: commitStateSuccess, description: "Deployed in 42s", previewURL: "https://preview--my-app.breezy.app"},
+			},
+			want: []CommitStatus{
+				{State: "pending", TargetURL: logsURL(branch), Description: "Building My App", Context: "breezy/my-app"},
+				{State: "success", TargetURL: "https://preview--my-app.breezy.app", Description: "Deployed in 42s", Context: "breezy/my-app"},
+			},
+		},
+		{
+			name:        "failure links the logs",
+			frontendURL: "https://dashboard.example.com",
+			reports: []report{
+				{deployment: preview, state: commitStatePending, description: "Building My App"},
+				{deployment: preview, state: commitStateFailure, description: "Build failed: exit status 1", previewURL: "https://pr-7--my-app.breezy.app"},
+			},
+			want: []CommitStatus{
+				{State: "pending", TargetURL: logsURL(preview), Description: "Building My App", Context: "breezy/my-app/preview"},
+				{State: "failure", TargetURL: logsURL(preview), Description: "Build failed: exit status 1", Context: "breezy/my-app/preview"},
+			},
+		},
+		{
+			name: "no dashboard",
+			reports: []report{
+				{deployment: branch, state: commitStateError, description: "Build cancelled"},
+			},
+			want: []CommitStatus{
+				{State: "error", Description: "Build cancelled", Context: "breezy/my-app"},
+			},
+		},
+		{
+			name: "long description",
+			reports: []report{
+				{deployment: branch, state: commitStateFailure, description: strings.Repeat("é", 200)},
+			},
+			want: []CommitStatus{
+				{State: "failure", Description: strings.Repeat("é", 139) + "…", Context: "breezy/my-app"},
+			},
+		},
+		{
+			name:  "server error",
+			codes: []int{http.StatusInternalServerError},
+			reports: []report{
+				{deployment: branch, state: commitStatePending, description: "Building My App"},
+				{deployment: branch, state: commitStateSuccess, description: "Deployed in 1m0s", previewURL: "https://preview--my-app.breezy.app"},
+			},
+			// The failed report is only logged, and the build reports on
+			want: []CommitStatus{
+				{State: "pending", Description: "Building My App", Context: "breezy/my-app"},
+				{State: "success", TargetURL: "https://preview--my-app.breezy.app", Description: "Deployed in 1m0s", Context: "breezy/my-app"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeStatusServer(t, tt.codes...)
+			bs := newCommitStatusBuildService(fake.URL, tt.frontendURL)
+
+			for _, r := range tt.reports {
+				deployment := *r.deployment
+				deployment.PreviewURL = r.previewURL
+				bs.postCommitStatus(context.Background(), "installation-token", repository, app, &deployment, r.state, r.description)
+			}
+
+			if len(fake.statuses) != len(tt.want) {
+				t.Fatalf("posted %d statuses, want %d: %+v", len(fake.statuses), len(tt.want), fake.statuses)
+			}
+			for i, want := range tt.want {
+				if fake.statuses[i] != want {
+					t.Errorf("status %d is %+v, want %+v", i, fake.statuses[i], want)
+				}
+				if want := "/repos/octo/site/statuses/" + sha; fake.paths[i] != want {
+					t.Errorf("status %d posted to %s, want %s", i, fake.paths[i], want)
+				}
+				if fake.auth[i] != "token installation-token" {
+					t.Errorf("status %d sent Authorization %q", i, fake.auth[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTruncateDescription(t *testing.T) {
+	tests := []struct {
+		description string
+		want        string
+	}{
+		{"", ""},
+		{"Preview ready", "Preview ready"},
+		{strings.Repeat("a", 140), strings.Repeat("a", 140)},
+		{strings.Repeat("a", 141), strings.Repeat("a", 139) + "…"},
+		{strings.Repeat("日", 150), strings.Repeat("日", 139) + "…"},
+	}
+
+	for _, tt := range tests {
+		got := truncateDescription(tt.description)
+		if got != tt.want {
+			t.Errorf("truncateDescription(%d runes) = %q, want %q", len([]rune(tt.description)), got, tt.want)
+		}
+		if n := len([]rune(got)); n > maxCommitStatusDescription {
+			t.Errorf("truncateDescription(%d runes) has %d runes", len([]rune(tt.description)), n)
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// pubCacheDir is where builds keep their pub cache, relative to the build
+// workspace
+const pubCacheDir = ".pub-cache"
+
+// Results of looking up a build's dependencies in the cache, recorded on
+// the deployment
+const (
+	DependencyCacheHit  = "hit"
+	DependencyCacheMiss = "miss"
+	// DependencyCacheCleared means the app's entries were cleared before
+	// the build, which then ran without the cache
+	DependencyCacheCleared = "cleared"
+)
+
+// DependencyCache keeps the pub caches of earlier builds so later builds
+// with the same pubspec.lock and Flutter SDK don't download everything
+// again. Entries are scoped to the user whose builds created them, so one
+// user's builds can never feed packages into another user's.
+//
+// Entries are immutable once stored: a build gets a copy of an entry and a
+// new entry is written to a temporary directory and renamed into place, so
+// concurrent builds never see a partial entry. When the cache grows past its
+// size limit the least recently used entries are removed.
+type DependencyCache struct {
+	dir     string
+	maxSize int64
+	// mutex serializes changes to entry metadata and eviction. Only the
+	// worker process touches the cache.
+	mutex sync.Mutex
+}
+
+// dependencyCacheEntry is the metadata stored next to an entry's files
+type dependencyCacheEntry struct {
+	LockHash string `json:"lockHash"`
+	SDK      string `json:"sdk"`
+	Size     int64  `json:"size"`
+	// Apps are the apps whose builds used the entry, so it can be cleared
+	// per app
+	Apps      []string  `json:"apps"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// DependencyCacheKey identifies a cache entry
+type DependencyCacheKey struct {
+	UserID   string
+	AppID    string
+	LockHash string
+	SDK      string
+}
+
+// NewDependencyCache returns the cache stored in dir, or nil if dir is
+// empty, which disables caching
+func NewDependencyCache(dir string, maxSize int64) *DependencyCache {
+	if dir == "" {
+		return nil
+	}
+
+	cache := &DependencyCache{dir: dir, maxSize: maxSize}
+	if err := os.MkdirAll(cache.tempDir(), 0755); err != nil {
+		logrus.WithError(err).Error("Failed to create dependency cache directory")
+	}
+	return cache
+}
+
+// RemoveTemp removes the temporary entries left by a crashed worker, which
+// are never renamed into place. Only the worker may call it, before it
+// takes any job: every server process creates a cache, and one started
+// while a build is storing an entry would remove it.
+func (c *DependencyCache) RemoveTemp() {
+	if err := os.RemoveAll(c.tempDir()); err != nil {
+		logrus.WithError(err).Error("Failed to remove temporary dependency cache entries")
+	}
+	if err := os.MkdirAll(c.tempDir(), 0755); err != nil {
+		logrus.WithError(err).Error("Failed to create dependency cache directory")
+	}
+}
+
+// pubCacheKey returns the cache key for a Flutter project, or nil if it
+// has no pubspec.lock to key the cache on
+func pubCacheKey(project *BuildProject) (*DependencyCacheKey, error) {
+	lock, err := readProjectFile(project.Path, "pubspec.lock")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(lock)
+	key := &DependencyCacheKey{
+		UserID:   project.App.UserId.Hex(),
+		AppID:    project.App.Id.Hex(),
+		LockHash: hex.EncodeToString(sum[:]),
+	}
+	if project.SDK != nil {
+		key.SDK = project.SDK.Version + "@" + project.SDK.Revision
+	}
+	return key, nil
+}
+
+// Restore copies the entry for key into dest and returns its size, or -1
+// if there is no entry. A failed restore leaves dest removed, so the build
+// can carry on without the cache.
+func (c *DependencyCache) Restore(key *DependencyCacheKey, dest string) (int64, error) {
+	entry := c.entryDir(key)
+	if !dirExists(entry) {
+		return -1, nil
+	}
+
+	// The entry may be evicted while it is copied, which fails the copy
+	if err := copyTree(filepath.Join(entry, "files"), dest); err != nil {
+		os.RemoveAll(dest)
+		return -1, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var size int64
+	err := c.updateEntry(entry, func(metadata *dependencyCacheEntry) {
+		size = metadata.Size
+		if !slices.Contains(metadata.Apps, key.AppID) {
+			metadata.Apps = append(metadata.Apps, key.AppID)
+		}
+	})
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to update dependency cache entry %s", entry)
+	}
+	return size, nil
+}
+
+// Store saves a copy of src as the entry for key, unless there already is
+// one, and evicts entries if the cache is over its size limit. It returns
+// the size of the entry.
+func (c *DependencyCache) Store(key *DependencyCacheKey, src string) (int64, error) {
+	entry := c.entryDir(key)
+	if dirExists(entry) {
+		return 0, nil
+	}
+
+	temp := filepath.Join(c.tempDir(), uuid.New().String())
+	defer os.RemoveAll(temp)
+	if err := copyTree(src, filepath.Join(temp, "files")); err != nil {
+		return 0, err
+	}
+
+	size, err := treeSize(temp)
+	if err != nil {
+		return 0, err
+	}
+	metadata := dependencyCacheEntry{
+		LockHash:  key.LockHash,
+		SDK:       key.SDK,
+		Size:      size,
+		Apps:      []string{key.AppID},
+		CreatedAt: time.Now(),
+	}
+	if err := writeJSONFile(filepath.Join(temp, "entry.json"), metadata); err != nil {
+		return 0, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(entry), 0755); err != nil {
+		return 0, err
+	}
+	// Another build may have stored the same entry in the meantime
+	if err := os.Rename(temp, entry); err != nil && !dirExists(entry) {
+		return 0, err
+	}
+
+	c.evict()
+	return size, nil
+}
+
+// ClearApp removes the user's entries that builds of the app used
+func (c *DependencyCache) ClearApp(userID, appID string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entries, err := c.entries(filepath.Join(c.dir, "pub", userID))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if slices.Contains(entry.metadata.Apps, appID) {
+			c.remove(entry.path)
+		}
+	}
+	return nil
+}
+
+type cachedEntry struct {
+	path     string
+	metadata dependencyCacheEntry
+	lastUsed time.Time
+}
+
+// evict removes the least recently used entries until the cache fits its
+// size limit
+func (c *DependencyCache) evict() {
+	if c.maxSize <= 0 {
+		return
+	}
+
+	users, err := os.ReadDir(filepath.Join(c.dir, "pub"))
+	if err != nil {
+		logrus.WithError(err).Error("Failed to read dependency cache")
+		return
+	}
+
+	all := []cachedEntry{}
+	var total int64
+	for _, user := range users {
+		entries, err := c.entries(filepath.Join(c.dir, "pub", user.Name()))
+		if err != nil {
+			logrus.WithError(err).Error("Failed to read dependency cache")
+			continue
+		}
+		for _, entry := range entries {
+			total += entry.metadata.Size
+			all = append(all, entry)
+		}
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].lastUsed.Before(all[j].lastUsed)
+	})
+	for _, entry := range all {
+		if total <= c.maxSize {
+			break
+		}
+		c.remove(entry.path)
+		total -= entry.metadata.Size
+		logrus.Infof("Evicted dependency cache entry %s (%d bytes)", entry.path, entry.metadata.Size)
+	}
+}
+
+// entries lists the entries in a user's cache directory
+func (c *DependencyCache) entries(dir string) ([]cachedEntry, error) {
+	dirs, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []cachedEntry{}
+	for _, d := range dirs {
+		path := filepath.Join(dir, d.Name())
+		metadataPath := filepath.Join(path, "entry.json")
+		info, err := os.Stat(metadataPath)
+		if err != nil {
+			continue
+		}
+
+		var metadata dependencyCacheEntry
+		data, err := os.ReadFile(metadataPath)
+		if err != nil || json.Unmarshal(data, &metadata) != nil {
+			continue
+		}
+		entries = append(entries, cachedEntry{path: path, metadata: metadata, lastUsed: info.ModTime()})
+	}
+	return entries, nil
+}
+
+// updateEntry rewrites an entry's metadata, which also marks it as used
+func (c *DependencyCache) updateEntry(entry string, update func(*dependencyCacheEntry)) error {
+	path := filepath.Join(entry, "entry.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var metadata dependencyCacheEntry
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return err
+	}
+	update(&metadata)
+
+	temp := filepath.Join(c.tempDir(), uuid.New().String()+".json")
+	if err := writeJSONFile(temp, metadata); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// remove moves an entry out of the way before deleting it, so a build
+// never finds a half deleted entry
+func (c *DependencyCache) remove(entry string) {
+	temp := filepath.Join(c.tempDir(), uuid.New().String())
+	if err := os.Rename(entry, temp); err != nil {
+		logrus.WithError(err).Errorf("Failed to remove dependency cache entry %s", entry)
+		return
+	}
+	os.RemoveAll(temp)
+}
+
+func (c *DependencyCache) entryDir(key *DependencyCacheKey) string {
+	sum := sha256.Sum256([]byte(key.LockHash + "\n" + key.SDK))
+	return filepath.Join(c.dir, "pub", key.UserID, hex.EncodeToString(sum[:16]))
+}
+
+func (c *DependencyCache) tempDir() string {
+	return filepath.Join(c.dir, "tmp")
+}
+
+// copyTree copies a directory tree. Symlinks are copied as links, never
+// followed, since builds control what they point to; other special files
+// are skipped.
+func copyTree(src, dest string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, 0755)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.Type().IsRegular():
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			return copyFile(path, target, info.Mode().Perm())
+		default:
+			return nil
+		}
+	})
+}
+
+func copyFile(src, dest string, mode fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// treeSize returns the total size of the regular files in a directory tree
+func treeSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func writeJSONFile(path string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// formatBytes formats a size for build logs
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,180 @@
+package services
+
+import (
+	"breezy/config"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// containerWorkspace is where the build workspace is mounted in containers
+const containerWorkspace = "/workspace"
+
+// DockerExecutor runs every build command in a fresh, locked down container
+// of the pinned build image. Only the build workspace is mounted, nothing
+// from the host environment is passed through and network access is opt-in
+// per command.
+type DockerExecutor struct {
+	config config.Docker
+}
+
+func NewDockerExecutor(config config.Docker) *DockerExecutor {
+	return &DockerExecutor{config: config}
+}
+
+func (e *DockerExecutor) Run(ctx context.Context, command BuildCommand) error {
+	if _, err := exec.LookPath("docker"); err != nil {
+		return fmt.Errorf("docker is not installed or not in PATH: %v", err)
+	}
+
+	workspace, err := filepath.Abs(command.Workspace)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("breezy-build-%s-%s", command.Name, uuid.New().String()[:8])
+	args := e.runArgs(name, workspace, command)
+
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	// Secrets reach the container through the docker CLI's environment, see
+	// runArgs
+	cmd.Env = append(e.dockerEnv(), command.SecretEnv...)
+	cmd.Stdout = command.Output
+	cmd.Stderr = command.Output
+	// Killing the docker client does not stop the container, so stop the
+	// container itself when the context is done
+	cmd.Cancel = func() error {
+		kill := exec.Command("docker", "kill", name)
+		kill.Env = e.dockerEnv()
+		return kill.Run()
+	}
+	cmd.WaitDelay = 30 * time.Second
+
+	return cmd.Run()
+}
+
+func (e *DockerExecutor) runArgs(name, workspace string, command BuildCommand) []string {
+	network := "none"
+	if command.Network {
+		network = "bridge"
+	}
+
+	args := []string{
+		"run", "--rm",
+		"--name", name,
+		"--label", "breezy.build=true",
+		"--network", network,
+		"--cap-drop", "ALL",
+		"--security-opt", "no-new-privileges",
+		// Run as the server user so the workspace stays removable by the host
+		"--user", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()),
+		"--volume", workspace + ":" + containerWorkspace,
+		"--workdir", path.Join(containerWorkspace, filepath.ToSlash(command.Dir)),
+		// Keep HOME and the pub cache inside the workspace so no host
+		// credentials or caches are visible to the build
+		"--env", "HOME=" + path.Join(containerWorkspace, ".home"),
+		"--env", "PUB_CACHE=" + path.Join(containerWorkspace, pubCacheDir),
+		"--env", "CI=true",
+	}
+
+	if e.config.CPUs != "" {
+		args = append(args, "--cpus", e.config.CPUs)
+	}
+	if e.config.Memory != "" {
+		args = append(args, "--memory", e.config.Memory, "--memory-swap", e.config.Memory)
+	}
+	if e.config.PidsLimit > 0 {
+		args = append(args, "--pids-limit", strconv.Itoa(e.config.PidsLimit))
+	}
+
+	if command.Mirror != "" {
+		args = append(args, "--volume", command.Mirror+":"+command.Mirror+":ro")
+	}
+
+	for _, env := range command.Env {
+		args = append(args, "--env", env)
+	}
+	// Only the name is passed, so docker copies the value from its own
+	// environment and it never shows up in the process list
+	for _, env := range command.SecretEnv {
+		name, _, _ := strings.Cut(env, "=")
+		args = append(args, "--env", name)
+	}
+
+	if command.FlutterSDK != "" {
+		args = append(args, "--pull", "never")
+	}
+
+	args = append(args, e.image(command))
+	return append(args, command.Args...)
+}
+
+// image returns the image for the command's toolchain. Flutter build images
+// are tagged by Flutter version and channel, so for a specific Flutter SDK
+// the tag of the configured image is swapped for the requested one.
+func (e *DockerExecutor) image(command BuildCommand) string {
+	switch command.Toolchain {
+	case ToolchainNode:
+		return e.config.NodeImage
+	case ToolchainHugo:
+		return e.config.HugoImage
+	}
+
+	if command.FlutterSDK == "" {
+		return e.config.BuildImage
+	}
+	return e.flutterRepository() + ":" + command.FlutterSDK
+}
+
+// FlutterSDKs lists the tags of the build image that have been pulled.
+// Builds never pull a specific Flutter version, so a version is only
+// available once its image is on the Docker host.
+func (e *DockerExecutor) FlutterSDKs(ctx context.Context) ([]string, error) {
+	cmd := exec.CommandContext(ctx, "docker", "image", "ls", "--format", "{{.Tag}}", e.flutterRepository())
+	cmd.Env = e.dockerEnv()
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list build images: %v", err)
+	}
+
+	sdks := []string{}
+	seen := map[string]bool{}
+	for _, tag := range strings.Fields(string(output)) {
+		if tag != "<none>" && !seen[tag] {
+			seen[tag] = true
+			sdks = append(sdks, tag)
+		}
+	}
+	return sdks, nil
+}
+
+// flutterRepository is the build image without its tag
+func (e *DockerExecutor) flutterRepository() string {
+	repository := e.config.BuildImage
+	if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+		repository = repository[:i]
+	}
+	return repository
+}
+
+// dockerEnv is the environment for the docker CLI itself. It points the CLI
+// at the configured daemon and passes nothing else from the server.
+func (e *DockerExecutor) dockerEnv() []string {
+	env := []string{"PATH=" + os.Getenv("PATH")}
+	if e.config.Host != "" {
+		env = append(env, "DOCKER_HOST="+e.config.Host)
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		env = append(env, "HOME="+home)
+	}
+	return env
+}
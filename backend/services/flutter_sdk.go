@@ -0,0 +1,303 @@
+package services
+
+import (
+	"breezy/model"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// flutterVersionCacheTTL is how long the version an SDK reports is reused.
+// Channel images and SDKs can be updated in place, so it isn't kept forever.
+const flutterVersionCacheTTL = 10 * time.Minute
+
+// FlutterSDKError is returned when no installed Flutter SDK can build the
+// project
+type FlutterSDKError struct {
+	Message string
+}
+
+func (e *FlutterSDKError) Error() string {
+	return e.Message
+}
+
+// FlutterSDKManager picks the Flutter SDK each build runs with from the
+// SDKs installed for the executor
+type FlutterSDKManager struct {
+	executor BuildExecutor
+	mutex    sync.Mutex
+	versions map[string]cachedFlutterVersion
+}
+
+type cachedFlutterVersion struct {
+	version *model.SDKVersion
+	expires time.Time
+}
+
+// flutterSDKRequest is the SDK a build asks for
+type flutterSDKRequest struct {
+	// Version is a version or channel, empty if nothing pins one
+	Version string
+	// Source is where Version comes from
+	Source string
+	// SDKConstraint and FlutterConstraint come from the pubspec.yaml
+	// environment
+	SDKConstraint     string
+	FlutterConstraint string
+}
+
+// flutterMachineVersion is the output of `flutter --version --machine`
+type flutterMachineVersion struct {
+	FrameworkVersion  string `json:"frameworkVersion"`
+	Channel           string `json:"channel"`
+	FrameworkRevision string `json:"frameworkRevision"`
+	EngineRevision    string `json:"engineRevision"`
+	DartSdkVersion    string `json:"dartSdkVersion"`
+}
+
+func NewFlutterSDKManager(executor BuildExecutor) *FlutterSDKManager {
+	return &FlutterSDKManager{
+		executor: executor,
+		versions: make(map[string]cachedFlutterVersion),
+	}
+}
+
+// Select returns the SDK to build with. A pinned version must be installed
+// and satisfy the pubspec constraints. Without a pin the default SDK is
+// used if it satisfies them, and otherwise the newest installed one that
+// does.
+func (m *FlutterSDKManager) Select(ctx context.Context, workspace string, request flutterSDKRequest, output io.Writer) (*model.SDKVersion, error) {
+	installed, err := m.executor.FlutterSDKs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.Version != "" {
+		if !slices.Contains(installed, request.Version) {
+			return nil, &FlutterSDKError{Message: fmt.Sprintf("Flutter %s requested by %s is not installed on this server (installed: %s)",
+				request.Version, request.Source, describeInstalled(installed))}
+		}
+
+		version, err := m.version(ctx, workspace, request.Version)
+		if err != nil {
+			return nil, err
+		}
+		if problem := request.check(version); problem != "" {
+			return nil, &FlutterSDKError{Message: fmt.Sprintf("Flutter %s requested by %s %s", request.Version, request.Source, problem)}
+		}
+
+		version.Requested = request.Version
+		version.Source = request.Source
+		return version, nil
+	}
+
+	version, err := m.version(ctx, workspace, "")
+	if err == nil && request.check(version) == "" {
+		version.Source = "default"
+		return version, nil
+	}
+	if err != nil {
+		fmt.Fprintf(output, "Default Flutter SDK unavailable: %v\n", err)
+	} else {
+		fmt.Fprintf(output, "Default Flutter %s %s, looking for another SDK\n", version.Version, request.check(version))
+	}
+
+	for _, candidate := range newestFirst(installed) {
+		version, err := m.version(ctx, workspace, candidate)
+		if err != nil {
+			fmt.Fprintf(output, "Skipping Flutter %s: %v\n", candidate, err)
+			continue
+		}
+		if request.check(version) == "" {
+			version.Requested = candidate
+			version.Source = "pubspec.yaml"
+			return version, nil
+		}
+	}
+
+	return nil, &FlutterSDKError{Message: fmt.Sprintf("no installed Flutter SDK satisfies pubspec.yaml (environment sdk: %q, flutter: %q); installed: %s",
+		request.SDKConstraint, request.FlutterConstraint, describeInstalled(installed))}
+}
+
+// version returns the version an SDK reports, running `flutter --version`
+// unless it was checked recently
+func (m *FlutterSDKManager) version(ctx context.Context, workspace, sdk string) (*model.SDKVersion, error) {
+	m.mutex.Lock()
+	cached, ok := m.versions[sdk]
+	m.mutex.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		version := *cached.version
+		return &version, nil
+	}
+
+	var output bytes.Buffer
+	err := m.executor.Run(ctx, BuildCommand{
+		Name:       "sdk",
+		Workspace:  workspace,
+		Args:       []string{"flutter", "--version", "--machine"},
+		Toolchain:  ToolchainFlutter,
+		FlutterSDK: sdk,
+		Output:     &output,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("flutter --version failed: %v", err)
+	}
+
+	// Flutter may print notices around the JSON
+	text := output.String()
+	start, end := strings.Index(text, "{"), strings.LastIndex(text, "}")
+	if start < 0 || end < start {
+		return nil, errors.New("flutter --version printed no version")
+	}
+
+	var machine flutterMachineVersion
+	if err := json.Unmarshal([]byte(text[start:end+1]), &machine); err != nil {
+		return nil, fmt.Errorf("failed to parse flutter --version: %v", err)
+	}
+
+	version := &model.SDKVersion{
+		Name:           ToolchainFlutter,
+		Version:        machine.FrameworkVersion,
+		Channel:        machine.Channel,
+		Revision:       machine.FrameworkRevision,
+		EngineRevision: machine.EngineRevision,
+		// Pre-release SDKs report e.g. "3.6.0 (build 3.6.0-334.3.beta)"
+		DartVersion: firstField(machine.DartSdkVersion),
+	}
+
+	m.mutex.Lock()
+	m.versions[sdk] = cachedFlutterVersion{version: version, expires: time.Now().Add(flutterVersionCacheTTL)}
+	m.mutex.Unlock()
+
+	copied := *version
+	return &copied, nil
+}
+
+// check returns why an SDK doesn't satisfy the pubspec constraints, or ""
+// if it does
+func (r flutterSDKRequest) check(version *model.SDKVersion) string {
+	if ok, err := satisfiesConstraint(version.DartVersion, r.SDKConstraint); err != nil || !ok {
+		return fmt.Sprintf("has Dart %s, but pubspec.yaml requires sdk %s", version.DartVersion, r.SDKConstraint)
+	}
+	if ok, err := satisfiesConstraint(version.Version, r.FlutterConstraint); err != nil || !ok {
+		return fmt.Sprintf("is version %s, but pubspec.yaml requires flutter %s", version.Version, r.FlutterConstraint)
+	}
+	return ""
+}
+
+// flutterSDKPin returns the Flutter version or channel the app or the
+// repository pins, and where the pin comes from. The app's setting wins
+// over breezy.yaml, which wins over FVM's config.
+func flutterSDKPin(project *BuildProject) (string, string, error) {
+	if project.App != nil && project.App.FlutterVersion != "" {
+		return project.App.FlutterVersion, "the app settings", nil
+	}
+	if version := project.Config.FlutterSDK(); version != "" {
+		return version, project.Config.file, nil
+	}
+
+	// FVM keeps its config next to the project or at the repository root
+	repoPath := filepath.Join(project.Workspace, sourceDir)
+	for _, dir := range []string{project.Path, repoPath} {
+		version, file, err := readFVMConfig(dir)
+		if err != nil {
+			return "", "", err
+		}
+		if version != "" {
+			return version, file, nil
+		}
+	}
+
+	return "", "", nil
+}
+
+// readFVMConfig reads the Flutter version from FVM's .fvmrc, or from the
+// .fvm/fvm_config.json of older FVM versions
+func readFVMConfig(dir string) (string, string, error) {
+	files := []struct {
+		name string
+		key  string
+	}{
+		{".fvmrc", "flutter"},
+		{filepath.Join(".fvm", "fvm_config.json"), "flutterSdkVersion"},
+	}
+
+	for _, file := range files {
+		data, err := readProjectFile(dir, file.name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", "", err
+		}
+
+		var config map[string]any
+		if err := json.Unmarshal(data, &config); err != nil {
+			return "", "", &BuildConfigError{File: file.name, Problems: []string{err.Error()}}
+		}
+		version, _ := config[file.key].(string)
+		if version == "" {
+			continue
+		}
+
+		// FVM allows pinning a version on a channel, e.g. 3.19.0@beta
+		version = strings.SplitN(version, "@", 2)[0]
+		if !model.IsFlutterVersion(version) {
+			return "", "", &BuildConfigError{File: file.name, Problems: []string{
+				fmt.Sprintf("%s: %q is not a Flutter version or channel Breezy can install", file.key, version),
+			}}
+		}
+		return version, file.name, nil
+	}
+
+	return "", "", nil
+}
+
+// newestFirst returns the installed versions, newest first, leaving out
+// channels
+func newestFirst(installed []string) []string {
+	type candidate struct {
+		name    string
+		version semver
+	}
+
+	candidates := []candidate{}
+	for _, name := range installed {
+		if version, err := parseSemver(name); err == nil {
+			candidates = append(candidates, candidate{name, version})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].version.compare(candidates[j].version) > 0
+	})
+
+	names := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		names[i] = candidate.name
+	}
+	return names
+}
+
+func describeInstalled(installed []string) string {
+	if len(installed) == 0 {
+		return "none besides the default"
+	}
+	return strings.Join(installed, ", ")
+}
+
+func firstField(s string) string {
+	if fields := strings.Fields(s); len(fields) > 0 {
+		return fields[0]
+	}
+	return ""
+}
@@ -0,0 +1,106 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// commitHashPattern matches a full SHA-1 or SHA-256 commit hash
+var commitHashPattern = regexp.MustCompile(`^([0-9a-f]{40}|[0-9a-f]{64})$`)
+
+// GitSource is the code a build checks out
+type GitSource struct {
+	RepoURL string
+	Branch  string
+	// Commit is the full SHA to build, empty for the tip of Branch
+	Commit string
+	// Credentials are used to fetch from the repository, nil for public
+	// repositories
+	Credentials *GitCredentials
+}
+
+// GitCommit describes the commit a build checked out
+type GitCommit struct {
+	Hash        string
+	Subject     string
+	AuthorName  string
+	AuthorEmail string
+	CommittedAt time.Time
+}
+
+// gitCommitFormat prints the fields of GitCommit one per line. The subject
+// goes last as it is the only one that may be empty.
+const gitCommitFormat = "--format=%H%n%an%n%ae%n%cI%n%s"
+
+// checkoutCommit fetches a single commit from url into the workspace's
+// source directory and checks it out. The commit doesn't have to be the
+// tip of a branch.
+func checkoutCommit(ctx context.Context, executor BuildExecutor, workspace, url, commit string, command BuildCommand) error {
+	command.Workspace = workspace
+	commands := [][]string{
+		{"git", "init", "--quiet", sourceDir},
+		{"git", "-C", sourceDir, "fetch", "--progress", "--no-tags", "--depth", "1", url, commit},
+		{"git", "-C", sourceDir, "checkout", "--quiet", "--detach", "FETCH_HEAD"},
+	}
+
+	for _, args := range commands {
+		command.Args = args
+		if err := executor.Run(ctx, command); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readCommit returns the commit checked out in the workspace's source
+// directory
+func readCommit(ctx context.Context, executor BuildExecutor, workspace string) (*GitCommit, error) {
+	var output bytes.Buffer
+	err := executor.Run(ctx, BuildCommand{
+		Name:      "clone",
+		Workspace: workspace,
+		Dir:       sourceDir,
+		Args:      []string{"git", "log", "-1", gitCommitFormat},
+		Output:    &output,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the checked out commit: %v: %s", err, strings.TrimSpace(output.String()))
+	}
+
+	return parseCommit(output.String())
+}
+
+func parseCommit(output string) (*GitCommit, error) {
+	lines := strings.SplitN(strings.TrimRight(output, "\n"), "\n", 5)
+	if len(lines) < 4 || len(lines[0]) < 40 {
+		return nil, fmt.Errorf("unexpected git log output %q", output)
+	}
+
+	committedAt, err := time.Parse(time.RFC3339, lines[3])
+	if err != nil {
+		return nil, fmt.Errorf("invalid commit date %q", lines[3])
+	}
+
+	commit := &GitCommit{
+		Hash:        lines[0],
+		AuthorName:  lines[1],
+		AuthorEmail: lines[2],
+		CommittedAt: committedAt,
+	}
+	if len(lines) == 5 {
+		commit.Subject = lines[4]
+	}
+	return commit, nil
+}
+
+// shortHash abbreviates a commit hash for messages
+func shortHash(hash string) string {
+	if len(hash) > 7 {
+		return hash[:7]
+	}
+	return hash
+}
@@ -0,0 +1,98 @@
+package services
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// gitAccessDeniedMessages are what git and GitHub print when a repository
+// can't be read with the credentials given. GitHub answers "not found" for
+// private repositories the credentials can't see.
+var gitAccessDeniedMessages = []string{
+	"authentication failed",
+	"repository not found",
+	"could not read username",
+	"could not read password",
+	"invalid username or password",
+	"the requested url returned error: 401",
+	"the requested url returned error: 403",
+	"the requested url returned error: 404",
+}
+
+// GitCredentials authenticate git to GitHub over HTTPS
+type GitCredentials struct {
+	// Token is a GitHub OAuth or installation access token
+	Token string
+}
+
+// RepositoryAccessError is returned when a repository can't be cloned
+// because the credentials can't read it
+type RepositoryAccessError struct {
+	RepoURL string
+}
+
+func (e *RepositoryAccessError) Error() string {
+	return fmt.Sprintf("repository access denied: %s doesn't exist or the app owner's GitHub account can't read it", e.RepoURL)
+}
+
+// gitEnv returns the environment git commands that reach GitHub run with.
+// The token is passed as an HTTP header through git's environment config,
+// so it is never written to .git/config or put on a command line, and git
+// only sends it to github.com.
+func gitEnv(credentials *GitCredentials) (env []string, secretEnv []string) {
+	env = []string{"GIT_TERMINAL_PROMPT=0"}
+	if credentials == nil || credentials.Token == "" {
+		return env, nil
+	}
+
+	basic := base64.StdEncoding.EncodeToString([]byte("x-access-token:" + credentials.Token))
+	env = append(env,
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http.https://github.com/.extraheader",
+	)
+	secretEnv = []string{"GIT_CONFIG_VALUE_0=AUTHORIZATION: basic " + basic}
+	return env, secretEnv
+}
+
+// gitAccessWriter passes git's output through while watching it for access
+// errors
+type gitAccessWriter struct {
+	output io.Writer
+	// tail keeps the end of the previous write, lowercased, so a message
+	// split across writes is still found
+	tail   []byte
+	denied bool
+}
+
+func newGitAccessWriter(output io.Writer) *gitAccessWriter {
+	return &gitAccessWriter{output: output}
+}
+
+func (w *gitAccessWriter) Write(p []byte) (int, error) {
+	text := append(w.tail, bytes.ToLower(p)...)
+	for _, message := range gitAccessDeniedMessages {
+		if strings.Contains(string(text), message) {
+			w.denied = true
+		}
+	}
+
+	const keep = 64
+	if len(text) > keep {
+		text = text[len(text)-keep:]
+	}
+	w.tail = append([]byte(nil), text...)
+
+	return w.output.Write(p)
+}
+
+// check turns the error of a git command that printed an access error into
+// a RepositoryAccessError
+func (w *gitAccessWriter) check(err error, repoURL string) error {
+	if err != nil && w.denied {
+		return &RepositoryAccessError{RepoURL: repoURL}
+	}
+	return err
+}
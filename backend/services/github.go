@@ -4,8 +4,10 @@ import (
 	"breezy/config"
 	"breezy/model"
 	"breezy/utils"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -13,14 +15,18 @@ import (
 	"strings"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type GitHubService struct {
 	config *config.Environment
 	db     *mongo.Database
+	// app is the GitHub App the server runs as, nil if it runs as none
+	app *GitHubApp
 }
 
 type GitHubUser struct {
@@ -54,6 +60,9 @@ type GitHubRepository struct {
 	Homepage      string `json:"homepage"`
 	Archived      bool   `json:"archived"`
 	Disabled      bool   `json:"disabled"`
+	Owner         struct {
+		Login string `json:"login"`
+	} `json:"owner"`
 }
 
 type GitHubTokenResponse struct {
@@ -65,9 +74,12 @@ type GitHubTokenResponse struct {
 }
 
 func NewGitHubService(config *config.Environment, database *mongo.Database) *GitHubService {
+	// LoadGitHubApp already failed at startup if the app can't be loaded
+	app, _ := LoadGitHubApp(config)
 	return &GitHubService{
 		config: config,
 		db:     database,
+		app:    app,
 	}
 }
 
@@ -77,12 +89,22 @@ func (g *GitHubService) GetAuthURL() (string, string) {
 	params := url.Values{}
 	params.Add("client_id", g.config.GitHub.ClientID)
 	params.Add("redirect_uri", g.config.GitHub.RedirectURL)
-	params.Add("scope", "repo user read:user user:email")
+	params.Add("scope", g.oauthScope())
 	params.Add("state", state)
 
 	return fmt.Sprintf("https://github.com/login/oauth/authorize?%s", params.Encode()), state
 }
 
+// oauthScope is the scope users sign in with. Running as a GitHub App,
+// repositories are accessed as the app, so sign-in only needs the user's
+// profile.
+func (g *GitHubService) oauthScope() string {
+	if g.app != nil {
+		return "read:user user:email"
+	}
+	return "repo user read:user user:email"
+}
+
 // ExchangeCodeForToken exchanges the authorization code for an access token
 func (g *GitHubService) ExchangeCodeForToken(code string) (*GitHubTokenResponse, error) {
 	data := url.Values{}
@@ -116,7 +138,7 @@ func (g *GitHubService) ExchangeCodeForToken(code string) (*GitHubTokenResponse,
 
 // GetUserInfo fetches user information from GitHub API
 func (g *GitHubService) GetUserInfo(accessToken string) (*GitHubUser, error) {
-	req, err := http.NewRequest("GET", "https://api.github.com/user", nil)
+	req, err := http.NewRequest("GET", g.apiURL("/user"), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -141,7 +163,7 @@ func (g *GitHubService) GetUserInfo(accessToken string) (*GitHubUser, error) {
 
 // GetUserEmail fetches the user's email from GitHub API
 func (g *GitHubService) GetUserEmail(accessToken string) (string, error) {
-	req, err := http.NewRequest("GET", "https://api.github.com/user/emails", nil)
+	req, err := http.NewRequest("GET", g.apiURL("/user/emails"), nil)
 	if err != nil {
 		return "", err
 	}
@@ -311,7 +333,7 @@ func (g *GitHubService) GetUserRepositories(userID string) ([]GitHubRepository,
 	}
 
 	// Fetch repositories from GitHub API
-	req, err := http.NewRequest("GET", "https://api.github.com/user/repos", nil)
+	req, err := http.NewRequest("GET", g.apiURL("/user/repos"), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -352,7 +374,7 @@ func (g *GitHubService) GetUserRepositories(userID string) ([]GitHubRepository,
 
 // ValidateGitHubToken checks if a GitHub token is still valid
 func (g *GitHubService) ValidateGitHubToken(accessToken string) error {
-	req, err := http.NewRequest("GET", "https://api.github.com/user", nil)
+	req, err := http.NewRequest("GET", g.apiURL("/user"), nil)
 	if err != nil {
 		return err
 	}
@@ -425,15 +447,6 @@ func (g *GitHubService) GetRepositoryBranches(userID string, repoURL string) ([]
 		return nil, fmt.Errorf("failed to get user: %v", err)
 	}
 
-	if user.GitHubToken == "" {
-		return nil, fmt.Errorf("user has no GitHub token")
-	}
-
-	// Validate the GitHub token first
-	if err := g.ValidateGitHubToken(user.GitHubToken); err != nil {
-		return nil, fmt.Errorf("GitHub token is invalid or expired: %v", err)
-	}
-
 	// Extract owner and repo name from the URL
 	// URL format: https://github.com/owner/repo
 	parts := strings.Split(repoURL, "/")
@@ -449,14 +462,26 @@ func (g *GitHubService) GetRepositoryBranches(userID string, repoURL string) ([]
 		repo = strings.Split(repo, ".")[0]
 	}
 
+	token, installationID, err := g.repositoryLookupToken(user, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate the GitHub token first
+	if installationID == 0 {
+		if err := g.ValidateGitHubToken(token); err != nil {
+			return nil, fmt.Errorf("GitHub token is invalid or expired: %v", err)
+		}
+	}
+
 	// Fetch branches from GitHub API
-	apiURL := fmt.Sprintf("https://api.github.com/repos/%s/%s/branches", owner, repo)
+	apiURL := g.apiURL(fmt.Sprintf("/repos/%s/%s/branches", owner, repo))
 	req, err := http.NewRequest("GET", apiURL, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("Authorization", "token "+user.GitHubToken)
+	req.Header.Set("Authorization", "token "+token)
 	req.Header.Set("Accept", "application/vnd.github.v3+json")
 
 	// Add query parameters for better results
@@ -526,3 +551,219 @@ func (g *GitHubService) ClearInvalidGitHubToken(userID string) error {
 	fmt.Printf("Debug: Cleared invalid GitHub token for user %s\n", userID)
 	return nil
 }
+
+// GitHubAPIError is a request the GitHub API refused
+type GitHubAPIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *GitHubAPIError) Error() string {
+	return fmt.Sprintf("GitHub API returned status %d: %s", e.StatusCode, e.Message)
+}
+
+// apiURL returns the URL of a path of the GitHub API
+func (g *GitHubService) apiURL(path string) string {
+	return strings.TrimSuffix(g.config.GitHub.APIURL, "/") + path
+}
+
+// apiRequest calls the GitHub API with an access token. The body is sent
+// and the response decoded into out when they aren't nil.
+func (g *GitHubService) apiRequest(method, accessToken, path string, body, out any) error {
+	return g.requestContext(context.Background(), method, "token "+accessToken, path, body, out)
+}
+
+// request calls the GitHub API with the given Authorization header
+func (g *GitHubService) request(method, authorization, path string, body, out any) error {
+	return g.requestContext(context.Background(), method, authorization, path, body, out)
+}
+
+// requestContext is request, given up when ctx is done
+func (g *GitHubService) requestContext(ctx context.Context, method, authorization, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, g.apiURL(path), reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		errorBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &GitHubAPIError{StatusCode: resp.StatusCode, Message: string(errorBody)}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// parseGitHubRepoURL returns the owner and name of a repository from its
+// URL, https://github.com/owner/repo with or without .git
+func parseGitHubRepoURL(repoURL string) (string, string, error) {
+	parsed, err := url.Parse(repoURL)
+	if err != nil || !strings.EqualFold(parsed.Host, "github.com") {
+		return "", "", fmt.Errorf("not a GitHub repository URL: %s", repoURL)
+	}
+
+	parts := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("not a GitHub repository URL: %s", repoURL)
+	}
+	return parts[0], strings.TrimSuffix(parts[1], ".git"), nil
+}
+
+// IsRepositoryURL reports whether repoURL is the URL of repository
+func IsRepositoryURL(repoURL string, repository *model.Repository) bool {
+	owner, name, err := parseGitHubRepoURL(repoURL)
+	return err == nil && strings.EqualFold(owner+"/"+name, repository.FullName)
+}
+
+// GetRepository fetches a repository the token can access
+func (g *GitHubService) GetRepository(accessToken, owner, name string) (*GitHubRepository, error) {
+	var repository GitHubRepository
+	path := fmt.Sprintf("/repos/%s/%s", url.PathEscape(owner), url.PathEscape(name))
+	if err := g.apiRequest(http.MethodGet, accessToken, path, nil, &repository); err != nil {
+		return nil, err
+	}
+	return &repository, nil
+}
+
+// LinkRepository records the GitHub repository at repoURL, as seen by the
+// user, so that its webhooks can be matched to the apps built from it
+func (g *GitHubService) LinkRepository(userID string, repoURL string) (*model.Repository, error) {
+	owner, name, err := parseGitHubRepoURL(repoURL)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := g.GetUserByID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %v", err)
+	}
+	token, _, err := g.repositoryLookupToken(user, owner, name)
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := g.GetRepository(token, owner, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Repositories are shared by every app built from them, whoever owns
+	// the apps
+	var repository model.Repository
+	err = g.db.Collection("repositories").FindOneAndUpdate(context.Background(),
+		bson.M{"githubRepoId": repo.ID},
+		bson.M{
+			"$set": bson.M{
+				"owner":         repo.Owner.Login,
+				"name":          repo.Name,
+				"fullName":      repo.FullName,
+				"description":   repo.Description,
+				"defaultBranch": repo.DefaultBranch,
+				"cloneURL":      repo.CloneURL,
+				"private":       repo.Private,
+			},
+			"$setOnInsert": bson.M{
+				"_id":       primitive.NewObjectID(),
+				"createdAt": time.Now(),
+			},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&repository)
+	if err != nil {
+		return nil, err
+	}
+
+	// The GitHub App's webhook delivers the events of repositories it is
+	// installed on, so those don't get a webhook of their own, and one
+	// registered before the app was installed is removed
+	installed, err := g.linkInstallation(&repository)
+	if err != nil {
+		logrus.WithError(err).Warnf("Failed to look up the GitHub App installation on %s", repository.FullName)
+	}
+	if installed {
+		token, err := g.repositoryInstallationToken(&repository)
+		if err == nil {
+			err = g.removeWebhook(token, &repository)
+		}
+		if err != nil {
+			logrus.WithError(err).Warnf("Failed to remove the webhook of %s", repository.FullName)
+		}
+		return &repository, nil
+	}
+
+	// Users sign in without access to their repositories when the server
+	// runs as a GitHub App, so only the app can deliver their events
+	if g.app != nil {
+		logrus.Warnf("%s isn't deployed on push until the GitHub App is installed on it", repository.FullName)
+		return &repository, nil
+	}
+
+	// Apps are still created without the webhook, they just aren't
+	// deployed on push
+	if err := g.registerWebhook(user.GitHubToken, &repository); err != nil {
+		logrus.WithError(err).Warnf("Failed to register a webhook on %s", repository.FullName)
+	}
+	return &repository, nil
+}
+
+// UpsertPullRequestComment updates the comment with the given ID on a pull
+// request, or posts a new one if there is none or it was deleted, and
+// returns the comment's ID
+func (g *GitHubService) UpsertPullRequestComment(accessToken, fullName string, number int, commentID int64, body string) (int64, error) {
+	payload := map[string]string{"body": body}
+
+	if commentID != 0 {
+		path := fmt.Sprintf("/repos/%s/issues/comments/%d", fullName, commentID)
+		err := g.apiRequest(http.MethodPatch, accessToken, path, payload, nil)
+		var apiErr *GitHubAPIError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+			return commentID, err
+		}
+	}
+
+	var comment struct {
+		ID int64 `json:"id"`
+	}
+	path := fmt.Sprintf("/repos/%s/issues/%d/comments", fullName, number)
+	if err := g.apiRequest(http.MethodPost, accessToken, path, payload, &comment); err != nil {
+		return 0, err
+	}
+	return comment.ID, nil
+}
+
+// CommitStatus is the status of a commit for one context, as shown next to
+// the commit and on its pull requests
+type CommitStatus struct {
+	// State is pending, success, failure or error
+	State       string `json:"state"`
+	TargetURL   string `json:"target_url,omitempty"`
+	Description string `json:"description,omitempty"`
+	Context     string `json:"context"`
+}
+
+// CreateCommitStatus sets the status of a commit for the status's context
+func (g *GitHubService) CreateCommitStatus(ctx context.Context, accessToken, fullName, sha string, status CommitStatus) error {
+	return g.requestContext(ctx, http.MethodPost, "token "+accessToken, fmt.Sprintf("/repos/%s/statuses/%s", fullName, sha), status, nil)
+}
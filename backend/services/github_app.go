@@ -0,0 +1,277 @@
+package services
+
+import (
+	"breezy/config"
+	"breezy/model"
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// githubAppHookTarget is the X-GitHub-Hook-Installation-Target-Type of the
+// deliveries of a GitHub App's webhook
+const githubAppHookTarget = "integration"
+
+// installationTokenMargin is how long before it expires an installation
+// token is renewed, so a token handed to a clone outlasts it
+const installationTokenMargin = 10 * time.Minute
+
+// GitHubApp is the GitHub App the server runs as. It keeps the tokens of
+// its installations until they are about to expire.
+type GitHubApp struct {
+	id            int64
+	key           *rsa.PrivateKey
+	webhookSecret string
+
+	mutex  sync.Mutex
+	tokens map[int64]installationToken
+}
+
+type installationToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+var (
+	githubAppOnce sync.Once
+	githubApp     *GitHubApp
+	githubAppErr  error
+)
+
+// LoadGitHubApp returns the GitHub App the server runs as, nil if none is
+// configured. It is loaded once and shared by every GitHubService, so
+// installation tokens are shared too.
+func LoadGitHubApp(env *config.Environment) (*GitHubApp, error) {
+	githubAppOnce.Do(func() {
+		githubApp, githubAppErr = newGitHubApp(env.GitHub.App)
+	})
+	return githubApp, githubAppErr
+}
+
+func newGitHubApp(appConfig config.GitHubApp) (*GitHubApp, error) {
+	if appConfig.ID == 0 {
+		return nil, nil
+	}
+
+	pem, err := os.ReadFile(appConfig.PrivateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the GitHub App private key: %v", err)
+	}
+	key, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the GitHub App private key: %v", err)
+	}
+
+	return &GitHubApp{
+		id:            appConfig.ID,
+		key:           key,
+		webhookSecret: appConfig.WebhookSecret,
+		tokens:        make(map[int64]installationToken),
+	}, nil
+}
+
+// ID returns the app's ID
+func (a *GitHubApp) ID() int64 {
+	return a.id
+}
+
+// jwt returns a JWT that authenticates as the app, valid for a few minutes.
+// It is issued a minute in the past to allow for clock drift.
+func (a *GitHubApp) jwt() (string, error) {
+	now := time.Now()
+	claims := jwt.RegisteredClaims{
+		Issuer:    strconv.FormatInt(a.id, 10),
+		IssuedAt:  jwt.NewNumericDate(now.Add(-time.Minute)),
+		ExpiresAt: jwt.NewNumericDate(now.Add(9 * time.Minute)),
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(a.key)
+}
+
+// appRequest calls the GitHub API as the app
+func (g *GitHubService) appRequest(method, path string, body, out any) error {
+	token, err := g.app.jwt()
+	if err != nil {
+		return fmt.Errorf("failed to sign GitHub App JWT: %v", err)
+	}
+	return g.request(method, "Bearer "+token, path, body, out)
+}
+
+// installationToken returns a token of an installation of the app, reusing
+// the last one until it is about to expire
+func (g *GitHubService) installationToken(installationID int64) (string, error) {
+	g.app.mutex.Lock()
+	cached, ok := g.app.tokens[installationID]
+	g.app.mutex.Unlock()
+	if ok && time.Until(cached.ExpiresAt) > installationTokenMargin {
+		return cached.Token, nil
+	}
+
+	var token installationToken
+	path := fmt.Sprintf("/app/installations/%d/access_tokens", installationID)
+	if err := g.appRequest(http.MethodPost, path, nil, &token); err != nil {
+		return "", err
+	}
+
+	g.app.mutex.Lock()
+	defer g.app.mutex.Unlock()
+	for id, entry := range g.app.tokens {
+		if time.Until(entry.ExpiresAt) <= installationTokenMargin {
+			delete(g.app.tokens, id)
+		}
+	}
+	g.app.tokens[installationID] = token
+	return token.Token, nil
+}
+
+// repositoryInstallation returns the installation of the app on a
+// repository, 0 if the app isn't installed on it
+func (g *GitHubService) repositoryInstallation(fullName string) (int64, error) {
+	var installation struct {
+		ID int64 `json:"id"`
+	}
+	err := g.appRequest(http.MethodGet, fmt.Sprintf("/repos/%s/installation", fullName), nil, &installation)
+	var apiErr *GitHubAPIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return installation.ID, nil
+}
+
+// linkInstallation records which installation of the app a repository is
+// accessed through, and reports whether the app is installed on it
+func (g *GitHubService) linkInstallation(repository *model.Repository) (bool, error) {
+	if g.app == nil {
+		return false, nil
+	}
+
+	installationID, err := g.repositoryInstallation(repository.FullName)
+	if err != nil {
+		return false, err
+	}
+	if installationID == repository.InstallationId {
+		return installationID != 0, nil
+	}
+
+	update := bson.M{"$set": bson.M{"installationId": installationID}}
+	if installationID == 0 {
+		update = bson.M{"$unset": bson.M{"installationId": ""}}
+	}
+	if _, err := g.db.Collection("repositories").UpdateOne(context.Background(), bson.M{"_id": repository.Id}, update); err != nil {
+		return false, err
+	}
+	repository.InstallationId = installationID
+	return installationID != 0, nil
+}
+
+// RepositoryToken returns the token to access a repository with on behalf
+// of a user: a token of the app's installation on the repository if the
+// server runs as a GitHub App installed on it, or else the user's OAuth
+// token. It returns "" if there is neither.
+func (g *GitHubService) RepositoryToken(repository *model.Repository, userID primitive.ObjectID) (string, error) {
+	if g.app != nil && repository != nil {
+		token, err := g.repositoryInstallationToken(repository)
+		if err != nil {
+			logrus.WithError(err).Warnf("Failed to get a GitHub App token for %s, using the user's token", repository.FullName)
+		}
+		if token != "" {
+			return token, nil
+		}
+	}
+
+	user, err := g.GetUserByID(userID.Hex())
+	if err != nil {
+		return "", fmt.Errorf("failed to load the app owner: %v", err)
+	}
+	return user.GitHubToken, nil
+}
+
+// repositoryInstallationToken returns a token of the app's installation on
+// a repository, "" if the app isn't installed on it. Repositories linked
+// before the app was installed have their installation looked up.
+func (g *GitHubService) repositoryInstallationToken(repository *model.Repository) (string, error) {
+	if repository.InstallationId == 0 {
+		installed, err := g.linkInstallation(repository)
+		if err != nil || !installed {
+			return "", err
+		}
+	}
+
+	token, err := g.installationToken(repository.InstallationId)
+	var apiErr *GitHubAPIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		// The app was uninstalled, or installed again under a new ID
+		if _, err := g.linkInstallation(repository); err != nil || repository.InstallationId == 0 {
+			return "", err
+		}
+		return g.installationToken(repository.InstallationId)
+	}
+	return token, err
+}
+
+// repositoryLookupToken returns the token to look up the repository
+// owner/name with on behalf of a user, and the installation it belongs to.
+// That is a token of the app's installation on the repository if the server
+// runs as a GitHub App installed on it and the user collaborates on the
+// repository, so the app can't be used to reach repositories of other
+// accounts it is installed on. Otherwise it is the user's OAuth token, with
+// installation 0.
+func (g *GitHubService) repositoryLookupToken(user *model.User, owner, name string) (string, int64, error) {
+	if g.app != nil {
+		fullName := owner + "/" + name
+		installationID, err := g.repositoryInstallation(fullName)
+		if err != nil {
+			logrus.WithError(err).Warnf("Failed to look up the GitHub App installation on %s, using the user's token", fullName)
+		}
+		if installationID != 0 {
+			token, err := g.installationToken(installationID)
+			if err != nil {
+				return "", 0, fmt.Errorf("failed to get a GitHub App token for %s: %v", fullName, err)
+			}
+			collaborator, err := g.isCollaborator(token, fullName, user.Username)
+			if err != nil {
+				return "", 0, err
+			}
+			if collaborator {
+				return token, installationID, nil
+			}
+		}
+	}
+
+	if user.GitHubToken == "" {
+		return "", 0, fmt.Errorf("user has no GitHub token")
+	}
+	return user.GitHubToken, 0, nil
+}
+
+// isCollaborator reports whether a GitHub user collaborates on a
+// repository, directly, through a team or as a member of its organization
+func (g *GitHubService) isCollaborator(accessToken, fullName, login string) (bool, error) {
+	if login == "" {
+		return false, nil
+	}
+	path := fmt.Sprintf("/repos/%s/collaborators/%s", fullName, url.PathEscape(login))
+	err := g.apiRequest(http.MethodGet, accessToken, path, nil, nil)
+	var apiErr *GitHubAPIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,254 @@
+package services
+
+import (
+	"breezy/model"
+	"breezy/utils"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// webhookEvents are the events the webhooks registered on repositories
+// deliver
+var webhookEvents = []string{"push", "pull_request"}
+
+// githubHook is a repository webhook as the GitHub API describes it
+type githubHook struct {
+	ID     int64 `json:"id"`
+	Config struct {
+		URL string `json:"url"`
+	} `json:"config"`
+}
+
+// registerWebhook registers a webhook with a secret of its own on a linked
+// repository that has none. The secret is stored before the webhook is
+// created, so that its first delivery can be checked, and storing it only
+// if there is none keeps two requests from both registering one.
+func (g *GitHubService) registerWebhook(accessToken string, repository *model.Repository) error {
+	if g.config.GitHub.WebhookURL == "" || repository.WebhookSecret != "" {
+		return nil
+	}
+
+	secret, err := generateWebhookSecret()
+	if err != nil {
+		return err
+	}
+	encrypted, err := g.encryptSecret(secret)
+	if err != nil {
+		return err
+	}
+
+	collection := g.db.Collection("repositories")
+	result, err := collection.UpdateOne(context.Background(),
+		bson.M{"_id": repository.Id, "webhookSecret": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"webhookSecret": encrypted}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return nil
+	}
+
+	hookID, err := g.createHook(accessToken, repository.FullName, secret)
+	if err != nil {
+		// The next app created from the repository tries again
+		collection.UpdateOne(context.Background(), bson.M{"_id": repository.Id}, bson.M{"$unset": bson.M{"webhookSecret": ""}})
+		return err
+	}
+	if _, err := collection.UpdateOne(context.Background(), bson.M{"_id": repository.Id}, bson.M{"$set": bson.M{"webhookId": hookID}}); err != nil {
+		return err
+	}
+
+	repository.WebhookId = hookID
+	repository.WebhookSecret = encrypted
+	return nil
+}
+
+// createHook creates the repository's webhook. A webhook to the server that
+// is already there, left by a repository record that was lost, is taken
+// over with the new secret.
+func (g *GitHubService) createHook(accessToken, fullName, secret string) (int64, error) {
+	hook := map[string]any{
+		"name":   "web",
+		"active": true,
+		"events": webhookEvents,
+		"config": map[string]string{
+			"url":          g.config.GitHub.WebhookURL,
+			"content_type": "json",
+			"secret":       secret,
+			"insecure_ssl": "0",
+		},
+	}
+
+	var created githubHook
+	err := g.apiRequest(http.MethodPost, accessToken, fmt.Sprintf("/repos/%s/hooks", fullName), hook, &created)
+	if err == nil {
+		return created.ID, nil
+	}
+	var apiErr *GitHubAPIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnprocessableEntity {
+		return 0, err
+	}
+
+	var hooks []githubHook
+	if listErr := g.apiRequest(http.MethodGet, accessToken, fmt.Sprintf("/repos/%s/hooks?per_page=100", fullName), nil, &hooks); listErr != nil {
+		return 0, err
+	}
+	for _, existing := range hooks {
+		if existing.Config.URL != g.config.GitHub.WebhookURL {
+			continue
+		}
+		delete(hook, "name")
+		path := fmt.Sprintf("/repos/%s/hooks/%d", fullName, existing.ID)
+		if err := g.apiRequest(http.MethodPatch, accessToken, path, hook, nil); err != nil {
+			return 0, err
+		}
+		return existing.ID, nil
+	}
+	return 0, err
+}
+
+// WebhookSecret returns the secret the deliveries of a webhook are signed
+// with, "" if there is no such webhook. target is what the webhook is
+// installed on: the GitHub App, for the app's webhook, or the GitHub
+// repository.
+func (g *GitHubService) WebhookSecret(target string, githubRepoID int64) (string, error) {
+	if target == githubAppHookTarget {
+		if g.app == nil {
+			return "", nil
+		}
+		return g.app.webhookSecret, nil
+	}
+
+	var repository model.Repository
+	err := g.db.Collection("repositories").FindOne(context.Background(), bson.M{"githubRepoId": githubRepoID}).Decode(&repository)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return "", nil
+	}
+	if err != nil || repository.WebhookSecret == "" {
+		return "", err
+	}
+	return g.decryptSecret(repository.WebhookSecret)
+}
+
+// ReleaseRepository removes a repository's webhook once no app is built
+// from it anymore, as the GitHub App or the user whose app was the last
+func (g *GitHubService) ReleaseRepository(userID string, repositoryID primitive.ObjectID) error {
+	if repositoryID.IsZero() {
+		return nil
+	}
+
+	count, err := g.db.Collection("apps").CountDocuments(context.Background(), bson.M{"repositoryId": repositoryID})
+	if err != nil || count > 0 {
+		return err
+	}
+
+	var repository model.Repository
+	err = g.db.Collection("repositories").FindOne(context.Background(), bson.M{"_id": repositoryID}).Decode(&repository)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if repository.WebhookId == 0 && repository.WebhookSecret == "" {
+		return nil
+	}
+	userObjectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return fmt.Errorf("invalid user ID: %v", err)
+	}
+	token, err := g.RepositoryToken(&repository, userObjectID)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return fmt.Errorf("no token to remove the webhook of %s with", repository.FullName)
+	}
+	return g.removeWebhook(token, &repository)
+}
+
+// removeWebhook deletes the webhook registered on a repository, if any
+func (g *GitHubService) removeWebhook(accessToken string, repository *model.Repository) error {
+	if repository.WebhookId == 0 && repository.WebhookSecret == "" {
+		return nil
+	}
+
+	if repository.WebhookId != 0 {
+		path := fmt.Sprintf("/repos/%s/hooks/%d", repository.FullName, repository.WebhookId)
+		err := g.apiRequest(http.MethodDelete, accessToken, path, nil, nil)
+		var apiErr *GitHubAPIError
+		if err != nil && (!errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound) {
+			return err
+		}
+	}
+
+	_, err := g.db.Collection("repositories").UpdateOne(context.Background(), bson.M{"_id": repository.Id}, bson.M{
+		"$unset": bson.M{"webhookId": "", "webhookSecret": ""},
+	})
+	if err != nil {
+		return err
+	}
+	repository.WebhookId = 0
+	repository.WebhookSecret = ""
+	return nil
+}
+
+// generateWebhookSecret returns a random secret to sign a webhook's
+// deliveries with
+func generateWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// encryptionKey is the AES-256 key secrets are stored with, derived from
+// the configured encryption key
+func (g *GitHubService) encryptionKey() ([]byte, error) {
+	if g.config.AppData.EncryptionKey == "" {
+		return nil, fmt.Errorf("ENCRYPTION_KEY is not set")
+	}
+	key := sha256.Sum256([]byte(g.config.AppData.EncryptionKey))
+	return key[:], nil
+}
+
+func (g *GitHubService) encryptSecret(secret string) (string, error) {
+	key, err := g.encryptionKey()
+	if err != nil {
+		return "", err
+	}
+	encrypted, err := utils.EncryptAES([]byte(secret), key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(encrypted), nil
+}
+
+func (g *GitHubService) decryptSecret(encrypted string) (string, error) {
+	key, err := g.encryptionKey()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+	secret, err := utils.DecryptAES(data, key)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret: %v", err)
+	}
+	return string(secret), nil
+}
@@ -0,0 +1,344 @@
+package services
+
+import (
+	"breezy/model"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// previewTeardownTimeout bounds removing the files of a closed pull
+// request's previews
+const previewTeardownTimeout = 5 * time.Minute
+
+// HandlePullRequestEvent builds a preview of every app of apps, those
+// built from the repository, when a pull request is opened or updated, and
+// tears the previews down when it is closed. Other actions are ignored. It
+// returns what the event did for each app.
+func (bs *BuildService) HandlePullRequestEvent(event *model.GitHubPullRequestEvent, apps []model.App) ([]model.WebhookDeliveryResult, error) {
+	switch event.Action {
+	case "opened", "synchronize", "reopened":
+		return bs.buildPullRequest(event, apps)
+	case "closed":
+		return bs.closePullRequest(event, apps)
+	}
+	return deliveryResults(apps, fmt.Sprintf("Pull requests being %s aren't handled", event.Action)), nil
+}
+
+// GetPreviews returns the pull request previews of the user's app, newest
+// first
+func (bs *BuildService) GetPreviews(appID, userID primitive.ObjectID) ([]model.PullRequestPreview, error) {
+	count, err := bs.db.Collection("apps").CountDocuments(context.Background(), bson.M{"_id": appID, "userId": userID})
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	cursor, err := bs.db.Collection("previews").Find(context.Background(), bson.M{"appId": appID},
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	previews := []model.PullRequestPreview{}
+	if err := cursor.All(context.Background(), &previews); err != nil {
+		return nil, err
+	}
+	return previews, nil
+}
+
+func (bs *BuildService) buildPullRequest(event *model.GitHubPullRequestEvent, apps []model.App) ([]model.WebhookDeliveryResult, error) {
+	// Builds clone with the app owner's credentials, which code from forks
+	// doesn't get to run with
+	head := event.PullRequest.Head
+	if head.Repo == nil || head.Repo.Id != event.Repository.Id {
+		logrus.Infof("Not previewing pull request %s#%d, which is from a fork", event.Repository.FullName, event.Number)
+		return deliveryResults(apps, "Pull requests from forks aren't previewed"), nil
+	}
+
+	results := make([]model.WebhookDeliveryResult, 0, len(apps))
+	var errs error
+	for _, app := range apps {
+		result := model.WebhookDeliveryResult{AppId: app.Id}
+		if err := bs.openPreview(&app, event); err != nil {
+			logrus.WithError(err).Errorf("Failed to open preview of pull request #%d for app %s", event.Number, app.Id.Hex())
+			errs = errors.Join(errs, err)
+			result.Message = fmt.Sprintf("Failed to open preview: %v", err)
+			results = append(results, result)
+			continue
+		}
+
+		job, err := bs.EnqueueBuild(app.Id.Hex(), app.UserId.Hex(), event.Repository.CloneURL, head.Ref, BuildOptions{
+			CommitSha:   head.Sha,
+			PullRequest: event.Number,
+		})
+		if err != nil {
+			logrus.WithError(err).Errorf("Failed to queue preview of pull request #%d for app %s", event.Number, app.Id.Hex())
+			errs = errors.Join(errs, err)
+			result.Message = fmt.Sprintf("Failed to queue preview: %v", err)
+			results = append(results, result)
+			continue
+		}
+		logrus.Infof("Queued build %s of pull request %s#%d for app %s", job.Id, event.Repository.FullName, event.Number, app.Id.Hex())
+		result.DeploymentId = &job.DeploymentId
+		result.Message = "Preview queued"
+		results = append(results, result)
+	}
+	return results, errs
+}
+
+// openPreview records the pull request's preview of an app, keeping the
+// deployment it serves until the new build succeeds
+func (bs *BuildService) openPreview(app *model.App, event *model.GitHubPullRequestEvent) error {
+	now := time.Now()
+	_, err := bs.db.Collection("previews").UpdateOne(context.Background(),
+		bson.M{"appId": app.Id, "number": event.Number},
+		bson.M{
+			"$set": bson.M{
+				"title":     event.PullRequest.Title,
+				"htmlURL":   event.PullRequest.HTMLURL,
+				"headRef":   event.PullRequest.Head.Ref,
+				"headSha":   event.PullRequest.Head.Sha,
+				"state":     model.PreviewStateOpen,
+				"url":       PullRequestPreviewURL(bs.config.Domain.AppDomain, event.Number, app.SanitizedName),
+				"updatedAt": now,
+			},
+			"$unset": bson.M{"closedAt": ""},
+			"$setOnInsert": bson.M{
+				"_id":       primitive.NewObjectID(),
+				"createdAt": now,
+			},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func (bs *BuildService) closePullRequest(event *model.GitHubPullRequestEvent, apps []model.App) ([]model.WebhookDeliveryResult, error) {
+	results := make([]model.WebhookDeliveryResult, 0, len(apps))
+	var errs error
+	for _, app := range apps {
+		result := model.WebhookDeliveryResult{AppId: app.Id, Message: "Preview closed"}
+
+		// The preview stops being served as soon as it is closed
+		var preview model.PullRequestPreview
+		err := bs.db.Collection("previews").FindOneAndUpdate(context.Background(),
+			bson.M{"appId": app.Id, "number": event.Number, "state": model.PreviewStateOpen},
+			bson.M{
+				"$set": bson.M{
+					"state":     model.PreviewStateClosed,
+					"closedAt":  time.Now(),
+					"updatedAt": time.Now(),
+				},
+				"$unset": bson.M{"deploymentId": ""},
+			},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&preview)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			result.Message = "No open preview"
+			results = append(results, result)
+			continue
+		}
+		if err != nil {
+			logrus.WithError(err).Errorf("Failed to close preview of pull request #%d for app %s", event.Number, app.Id.Hex())
+			errs = errors.Join(errs, err)
+			result.Message = fmt.Sprintf("Failed to close preview: %v", err)
+			results = append(results, result)
+			continue
+		}
+
+		bs.stopPreviewBuilds(&app, event.Number)
+		go bs.tearDownPreview(app, preview)
+		results = append(results, result)
+	}
+	return results, errs
+}
+
+// stopPreviewBuilds cancels the queued and running builds of a pull
+// request's preview
+func (bs *BuildService) stopPreviewBuilds(app *model.App, number int) {
+	cursor, err := bs.db.Collection("deployments").Find(context.Background(), bson.M{
+		"appId":       app.Id,
+		"pullRequest": number,
+		"status":      bson.M{"$in": activeDeploymentStatuses},
+	})
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to find builds of pull request #%d for app %s", number, app.Id.Hex())
+		return
+	}
+
+	var deployments []model.Deployment
+	if err := cursor.All(context.Background(), &deployments); err != nil {
+		logrus.WithError(err).Errorf("Failed to find builds of pull request #%d for app %s", number, app.Id.Hex())
+		return
+	}
+
+	for i := range deployments {
+		if _, err := bs.stopBuild(&deployments[i], app.UserId.Hex(), model.DeploymentStatusCancelled, "Pull request closed"); err != nil {
+			logrus.WithError(err).Errorf("Failed to stop build %s", deployments[i].Id.Hex())
+		}
+	}
+}
+
+// tearDownPreview removes the files of every deployment of a closed pull
+// request. A deployment that was promoted by hand and is live keeps them.
+func (bs *BuildService) tearDownPreview(app model.App, preview model.PullRequestPreview) {
+	ctx, cancel := context.WithTimeout(context.Background(), previewTeardownTimeout)
+	defer cancel()
+
+	cursor, err := bs.db.Collection("deployments").Find(ctx, bson.M{
+		"appId":          app.Id,
+		"pullRequest":    preview.Number,
+		"artifactPrefix": bson.M{"$exists": true},
+	})
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to find deployments of pull request #%d for app %s", preview.Number, app.Id.Hex())
+		return
+	}
+
+	var deployments []model.Deployment
+	if err := cursor.All(ctx, &deployments); err != nil {
+		logrus.WithError(err).Errorf("Failed to find deployments of pull request #%d for app %s", preview.Number, app.Id.Hex())
+		return
+	}
+
+	removed := 0
+	for _, deployment := range deployments {
+		if app.CurrentDeploymentId != nil && *app.CurrentDeploymentId == deployment.Id {
+			continue
+		}
+		if err := bs.artifacts.DeletePrefix(ctx, deployment.ArtifactPrefix); err != nil {
+			logrus.WithError(err).Errorf("Failed to remove the files of deployment %s", deployment.Id.Hex())
+			continue
+		}
+		_, err := bs.db.Collection("deployments").UpdateOne(ctx, bson.M{"_id": deployment.Id}, bson.M{
+			"$unset": bson.M{
+				"artifactPrefix": "",
+				"artifactFiles":  "",
+				"artifactSize":   "",
+				"staticFilesURL": "",
+				"previewURL":     "",
+			},
+		})
+		if err != nil {
+			logrus.WithError(err).Errorf("Failed to update deployment %s", deployment.Id.Hex())
+			continue
+		}
+		removed++
+	}
+	logrus.Infof("Removed %d deployments of pull request #%d for app %s", removed, preview.Number, app.Id.Hex())
+
+	bs.reportPreview(&app, &preview, fmt.Sprintf("The preview of **%s** was removed as the pull request was closed.", app.Name))
+}
+
+// publishPreview serves a successful build of a pull request at the pull
+// request's preview URL and reports it on the pull request
+func (bs *BuildService) publishPreview(app *model.App, deployment *model.Deployment) error {
+	var preview model.PullRequestPreview
+	err := bs.db.Collection("previews").FindOneAndUpdate(context.Background(),
+		bson.M{"appId": deployment.AppId, "number": deployment.PullRequest, "state": model.PreviewStateOpen},
+		bson.M{"$set": bson.M{
+			"deploymentId": deployment.Id,
+			"updatedAt":    time.Now(),
+		}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&preview)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return fmt.Errorf("pull request #%d is closed", deployment.PullRequest)
+	}
+	if err != nil {
+		return err
+	}
+
+	bs.reportPreview(app, &preview, fmt.Sprintf("The preview of **%s** for %s is ready at %s",
+		app.Name, shortHash(deployment.GitCommitHash), preview.URL))
+	return nil
+}
+
+// reportPreviewFailure tells a pull request that its preview failed to
+// build. The preview keeps serving its last successful build.
+func (bs *BuildService) reportPreviewFailure(deploymentID primitive.ObjectID, message string) {
+	deployment, err := bs.getDeployment(deploymentID)
+	if err != nil || deployment.PullRequest == 0 {
+		return
+	}
+
+	app, err := bs.getApp(deployment.AppId)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to load app %s", deployment.AppId.Hex())
+		return
+	}
+
+	var preview model.PullRequestPreview
+	err = bs.db.Collection("previews").FindOne(context.Background(), bson.M{
+		"appId":  deployment.AppId,
+		"number": deployment.PullRequest,
+		"state":  model.PreviewStateOpen,
+	}).Decode(&preview)
+	if err != nil {
+		return
+	}
+
+	bs.reportPreview(app, &preview, fmt.Sprintf("The preview of **%s** for %s failed to build.\n\n```\n%s\n```",
+		app.Name, shortHash(deployment.GitCommitHash), message))
+}
+
+// reportPreview posts the status of a preview on its pull request, as the
+// GitHub App or the app owner. Each preview has a single comment that is
+// kept up to date.
+func (bs *BuildService) reportPreview(app *model.App, preview *model.PullRequestPreview, body string) {
+	var repository model.Repository
+	err := bs.db.Collection("repositories").FindOne(context.Background(), bson.M{"_id": app.RepositoryId}).Decode(&repository)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to load the repository of app %s", app.Id.Hex())
+		return
+	}
+
+	token, err := bs.github.RepositoryToken(&repository, app.UserId)
+	if err != nil || token == "" {
+		logrus.Warnf("Not reporting the preview of pull request #%d for app %s, there is no token to access %s", preview.Number, app.Id.Hex(), repository.FullName)
+		return
+	}
+
+	commentID, err := bs.github.UpsertPullRequestComment(token, repository.FullName, preview.Number, preview.CommentId, body)
+	if err != nil {
+		logrus.WithError(err).Warnf("Failed to comment on pull request %s#%d", repository.FullName, preview.Number)
+		return
+	}
+	if commentID != preview.CommentId {
+		preview.CommentId = commentID
+		bs.db.Collection("previews").UpdateOne(context.Background(), bson.M{"_id": preview.Id}, bson.M{"$set": bson.M{"commentId": commentID}})
+	}
+}
+
+// linkedApps returns the active apps built from a GitHub repository
+func (bs *BuildService) linkedApps(githubRepoID int64) ([]model.App, error) {
+	var repository model.Repository
+	err := bs.db.Collection("repositories").FindOne(context.Background(), bson.M{"githubRepoId": githubRepoID}).Decode(&repository)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := bs.db.Collection("apps").Find(context.Background(), bson.M{"repositoryId": repository.Id, "isActive": true})
+	if err != nil {
+		return nil, err
+	}
+
+	apps := []model.App{}
+	if err := cursor.All(context.Background(), &apps); err != nil {
+		return nil, err
+	}
+	return apps, nil
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package services
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts the command in its own process group and makes
+// cancelling it kill the whole group, so tools that spawn children (flutter
+// starts dart, git starts remote helpers) don't leave orphans behind
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,116 @@
+package services
+
+import (
+	"breezy/model"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// ErrDeploymentNotPromotable is returned when promoting a deployment
+	// that didn't build successfully or has no stored files
+	ErrDeploymentNotPromotable = errors.New("deployment can't be promoted")
+	// ErrDeploymentLive is returned when promoting the deployment that is
+	// already live
+	ErrDeploymentLive = errors.New("deployment is already live")
+)
+
+// PromoteDeployment makes an earlier successful deployment of the user's
+// app live again, without rebuilding it. Its files are still in the
+// artifact store, so this is how a bad release is rolled back.
+func (bs *BuildService) PromoteDeployment(appID, deploymentID, userID primitive.ObjectID) (*model.Promotion, error) {
+	var app model.App
+	err := bs.db.Collection("apps").FindOne(context.Background(), bson.M{"_id": appID, "userId": userID}).Decode(&app)
+	if err != nil {
+		return nil, err
+	}
+
+	var deployment model.Deployment
+	err = bs.db.Collection("deployments").FindOne(context.Background(), bson.M{"_id": deploymentID, "appId": appID}).Decode(&deployment)
+	if err != nil {
+		return nil, err
+	}
+	if deployment.Status != model.DeploymentStatusSuccess || deployment.ArtifactPrefix == "" {
+		return nil, ErrDeploymentNotPromotable
+	}
+	if app.CurrentDeploymentId != nil && *app.CurrentDeploymentId == deploymentID {
+		return nil, ErrDeploymentLive
+	}
+
+	return bs.promote(&deployment, model.PromotionTriggerManual, &userID)
+}
+
+// GetPromotions returns the promotion history of the user's app, newest
+// first
+func (bs *BuildService) GetPromotions(appID, userID primitive.ObjectID, limit int64) ([]model.Promotion, error) {
+	count, err := bs.db.Collection("apps").CountDocuments(context.Background(), bson.M{"_id": appID, "userId": userID})
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	cursor, err := bs.db.Collection("promotions").Find(context.Background(), bson.M{"appId": appID},
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+
+	promotions := []model.Promotion{}
+	if err := cursor.All(context.Background(), &promotions); err != nil {
+		return nil, err
+	}
+	return promotions, nil
+}
+
+// promote points the app at the deployment in a single update, records the
+// promotion and tells the app owner's clients
+func (bs *BuildService) promote(deployment *model.Deployment, trigger model.PromotionTrigger, userID *primitive.ObjectID) (*model.Promotion, error) {
+	var previous model.App
+	err := bs.db.Collection("apps").FindOneAndUpdate(context.Background(),
+		bson.M{"_id": deployment.AppId},
+		bson.M{"$set": bson.M{
+			"currentDeploymentId": deployment.Id,
+			"staticFilesURL":      deployment.StaticFilesURL,
+			"project":             deployment.Project,
+			"updatedAt":           time.Now(),
+		}},
+		options.FindOneAndUpdate().SetReturnDocument(options.Before),
+	).Decode(&previous)
+	if err != nil {
+		return nil, err
+	}
+
+	promotion := &model.Promotion{
+		Id:                   primitive.NewObjectID(),
+		AppId:                deployment.AppId,
+		DeploymentId:         deployment.Id,
+		PreviousDeploymentId: previous.CurrentDeploymentId,
+		Trigger:              trigger,
+		UserId:               userID,
+		CreatedAt:            time.Now(),
+	}
+	if _, err := bs.db.Collection("promotions").InsertOne(context.Background(), promotion); err != nil {
+		return nil, fmt.Errorf("deployment promoted but not recorded: %v", err)
+	}
+
+	bs.wsService.BroadcastUpdate(BuildUpdate{
+		Type:         "deployment_promoted",
+		AppID:        deployment.AppId.Hex(),
+		UserID:       previous.UserId.Hex(),
+		DeploymentID: deployment.Id.Hex(),
+		Status:       string(model.DeploymentStatusSuccess),
+		Message:      fmt.Sprintf("Deployment %s is live", deployment.Id.Hex()),
+		Data:         promotion,
+		Timestamp:    promotion.CreatedAt,
+	})
+	return promotion, nil
+}
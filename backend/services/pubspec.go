@@ -0,0 +1,115 @@
+package services
+
+import (
+	"breezy/model"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PubspecYaml holds the parts of a Flutter project's pubspec.yaml that
+// matter to a build
+type PubspecYaml struct {
+	Name        string             `yaml:"name" json:"name"`
+	Description string             `yaml:"description" json:"description"`
+	Version     string             `yaml:"version" json:"version"`
+	Homepage    string             `yaml:"homepage" json:"homepage"`
+	Environment PubspecEnvironment `yaml:"environment" json:"environment"`
+	// Dependencies and DevDependencies are kept as nodes since a dependency
+	// is either a version constraint or a map describing its source
+	Dependencies    yaml.Node `yaml:"dependencies" json:"-"`
+	DevDependencies yaml.Node `yaml:"dev_dependencies" json:"-"`
+}
+
+// PubspecEnvironment holds the SDK constraints of a pubspec
+type PubspecEnvironment struct {
+	SDK     string `yaml:"sdk" json:"sdk"`
+	Flutter string `yaml:"flutter" json:"flutter"`
+}
+
+// parsePubspecYaml reads the pubspec.yaml of the Flutter project at
+// projectPath
+func parsePubspecYaml(projectPath string) (*PubspecYaml, error) {
+	data, err := readProjectFile(projectPath, "pubspec.yaml")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pubspec.yaml: %v", err)
+	}
+
+	pubspec := &PubspecYaml{}
+	if err := yaml.Unmarshal(data, pubspec); err != nil {
+		return nil, fmt.Errorf("failed to parse pubspec.yaml: %v", err)
+	}
+
+	if pubspec.Name == "" {
+		return nil, errors.New("pubspec.yaml has no name")
+	}
+	if pubspec.Dependencies.Kind != 0 && pubspec.Dependencies.Kind != yaml.MappingNode {
+		return nil, errors.New("pubspec.yaml: dependencies must be a map of package names")
+	}
+	if pubspec.DevDependencies.Kind != 0 && pubspec.DevDependencies.Kind != yaml.MappingNode {
+		return nil, errors.New("pubspec.yaml: dev_dependencies must be a map of package names")
+	}
+
+	return pubspec, nil
+}
+
+// Metadata returns the project metadata recorded on the deployment
+func (p *PubspecYaml) Metadata() *model.ProjectMetadata {
+	metadata := &model.ProjectMetadata{
+		Name:              p.Name,
+		Description:       strings.TrimSpace(p.Description),
+		Version:           p.Version,
+		SDKConstraint:     p.Environment.SDK,
+		FlutterConstraint: p.Environment.Flutter,
+	}
+
+	metadata.Dependencies = append(metadata.Dependencies, pubspecDependencies(&p.Dependencies, false)...)
+	metadata.Dependencies = append(metadata.Dependencies, pubspecDependencies(&p.DevDependencies, true)...)
+	return metadata
+}
+
+// pubspecDependencies lists the dependencies in a dependencies map, in the
+// order they are written
+func pubspecDependencies(node *yaml.Node, dev bool) []model.ProjectDependency {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	dependencies := make([]model.ProjectDependency, 0, len(node.Content)/2)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		dependency := model.ProjectDependency{
+			Name:   node.Content[i].Value,
+			Source: "hosted",
+			Dev:    dev,
+		}
+
+		value := node.Content[i+1]
+		switch value.Kind {
+		case yaml.ScalarNode:
+			// A bare constraint; an empty one means any version
+			dependency.Constraint = value.Value
+			if value.Tag == "!!null" || dependency.Constraint == "" {
+				dependency.Constraint = "any"
+			}
+		case yaml.MappingNode:
+			var source map[string]any
+			if err := value.Decode(&source); err == nil {
+				for _, kind := range []string{"sdk", "git", "path", "hosted"} {
+					if _, ok := source[kind]; ok {
+						dependency.Source = kind
+						break
+					}
+				}
+				if version, ok := source["version"].(string); ok {
+					dependency.Constraint = version
+				}
+			}
+		}
+
+		dependencies = append(dependencies, dependency)
+	}
+
+	return dependencies
+}
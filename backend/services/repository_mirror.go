@@ -0,0 +1,265 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// mirrorTempPrefix marks mirrors that are still being created
+const mirrorTempPrefix = ".tmp-"
+
+// mirrorNamePattern matches what is kept of a repository's name in its
+// mirror's directory name
+var mirrorNamePattern = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// RepositoryMirrors keeps a bare mirror of every repository that is built,
+// so a build only fetches the commits it doesn't have yet and then clones
+// from the mirror on disk.
+//
+// Mirrors are shared by everyone building the same repository. They are
+// only ever written by fetching from the repository itself, and every build
+// fetches before cloning, so a build can't use what it couldn't fetch.
+type RepositoryMirrors struct {
+	dir      string
+	maxAge   time.Duration
+	executor BuildExecutor
+
+	// locks serializes work on each mirror, keyed by its path. Only the
+	// worker process touches the mirrors.
+	mutex sync.Mutex
+	locks map[string]chan struct{}
+}
+
+// NewRepositoryMirrors returns the mirrors stored in dir, or nil if dir is
+// empty, which has every build clone from the network
+func NewRepositoryMirrors(dir string, maxAge time.Duration, executor BuildExecutor) *RepositoryMirrors {
+	if dir == "" {
+		return nil
+	}
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to resolve repository mirror directory")
+		return nil
+	}
+	if err := os.MkdirAll(absDir, 0755); err != nil {
+		logrus.WithError(err).Error("Failed to create repository mirror directory")
+	}
+
+	return &RepositoryMirrors{
+		dir:      absDir,
+		maxAge:   maxAge,
+		executor: executor,
+		locks:    make(map[string]chan struct{}),
+	}
+}
+
+// Clone fetches the branch, or the commit, into the repository's mirror,
+// creating the mirror if needed, and then clones it from there into the
+// workspace. Only the fetch uses the credentials.
+func (m *RepositoryMirrors) Clone(ctx context.Context, source GitSource, workspace string, output io.Writer) error {
+	// The branch ends up in a refspec, where it could otherwise name other
+	// refs of the shared mirror
+	if !isValidBranchName(source.Branch) {
+		return fmt.Errorf("invalid branch name %q", source.Branch)
+	}
+
+	mirror := m.path(source.RepoURL)
+
+	unlock, err := m.lock(ctx, mirror)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if !dirExists(mirror) {
+		fmt.Fprintln(output, "Creating repository mirror")
+		if err := m.create(ctx, mirror, output); err != nil {
+			return err
+		}
+	}
+
+	// Only the branch being built is fetched, and only what the mirror is
+	// missing of it. Forced so rewritten history replaces the old. A commit
+	// gets a ref of its own so the mirror keeps it even if it isn't on the
+	// branch.
+	refspecs := []string{"+refs/heads/" + source.Branch + ":refs/heads/" + source.Branch}
+	if source.Commit != "" {
+		refspecs = append(refspecs, source.Commit+":refs/breezy/commits/"+source.Commit)
+	}
+	env, secretEnv := gitEnv(source.Credentials)
+	fetchOutput := newGitAccessWriter(output)
+	err = m.executor.Run(ctx, BuildCommand{
+		Name:      "clone",
+		Workspace: mirror,
+		Args:      append([]string{"git", "fetch", "--progress", "--no-tags", source.RepoURL}, refspecs...),
+		Env:       env,
+		SecretEnv: secretEnv,
+		Network:   true,
+		Output:    fetchOutput,
+	})
+	if err = fetchOutput.check(err, source.RepoURL); err != nil {
+		var accessErr *RepositoryAccessError
+		if errors.As(err, &accessErr) {
+			return err
+		}
+		return fmt.Errorf("failed to fetch %s: %v", source.Branch, err)
+	}
+
+	// Mark the mirror as used so it isn't pruned
+	now := time.Now()
+	os.Chtimes(mirror, now, now)
+
+	mirrorURL := "file://" + filepath.ToSlash(mirror)
+	if source.Commit != "" {
+		return checkoutCommit(ctx, m.executor, workspace, mirrorURL, source.Commit, BuildCommand{
+			Name:   "clone",
+			Mirror: mirror,
+			Output: output,
+		})
+	}
+
+	return m.executor.Run(ctx, BuildCommand{
+		Name:      "clone",
+		Workspace: workspace,
+		Args:      []string{"git", "clone", "--progress", "--depth", "1", "--branch", source.Branch, mirrorURL, sourceDir},
+		Mirror:    mirror,
+		Output:    output,
+	})
+}
+
+// Prune removes the mirrors of repositories that haven't been built for
+// longer than the maximum age, skipping mirrors that are in use
+func (m *RepositoryMirrors) Prune() {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to read repository mirrors")
+		return
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !entry.IsDir() || time.Since(info.ModTime()) < m.maxAge {
+			continue
+		}
+
+		mirror := filepath.Join(m.dir, entry.Name())
+		if strings.HasPrefix(entry.Name(), mirrorTempPrefix) {
+			// Left by a worker that stopped while creating a mirror
+			os.RemoveAll(mirror)
+			continue
+		}
+
+		unlock, ok := m.tryLock(mirror)
+		if !ok {
+			continue
+		}
+		if err := os.RemoveAll(mirror); err != nil {
+			logrus.WithError(err).Errorf("Failed to prune repository mirror %s", entry.Name())
+		} else {
+			logrus.Infof("Pruned repository mirror %s, unused since %s", entry.Name(), info.ModTime().Format(time.RFC3339))
+		}
+		unlock()
+	}
+}
+
+// create initializes an empty mirror. It is set up next to its final path
+// and renamed into place, so a mirror that exists is always usable.
+func (m *RepositoryMirrors) create(ctx context.Context, mirror string, output io.Writer) error {
+	temp := filepath.Join(m.dir, mirrorTempPrefix+uuid.New().String())
+	defer os.RemoveAll(temp)
+	if err := os.MkdirAll(temp, 0755); err != nil {
+		return err
+	}
+
+	err := m.executor.Run(ctx, BuildCommand{
+		Name:      "clone",
+		Workspace: temp,
+		Args:      []string{"git", "init", "--bare", "--quiet"},
+		Output:    output,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create repository mirror: %v", err)
+	}
+
+	return os.Rename(temp, mirror)
+}
+
+// path returns the mirror directory of a repository. The name keeps the
+// repository's name readable and a hash of its URL unique.
+func (m *RepositoryMirrors) path(repoURL string) string {
+	normalized := strings.ToLower(strings.TrimSpace(repoURL))
+	normalized = strings.TrimSuffix(strings.TrimSuffix(normalized, "/"), ".git")
+
+	sum := sha256.Sum256([]byte(normalized))
+	name := mirrorNamePattern.ReplaceAllString(path.Base(normalized), "-")
+	return filepath.Join(m.dir, fmt.Sprintf("%s-%s.git", strings.Trim(name, ".-"), hex.EncodeToString(sum[:6])))
+}
+
+// lock waits for exclusive use of a mirror and returns the function that
+// releases it
+func (m *RepositoryMirrors) lock(ctx context.Context, mirror string) (func(), error) {
+	lock := m.mirrorLock(mirror)
+	select {
+	case lock <- struct{}{}:
+		return func() { <-lock }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// tryLock takes a mirror's lock if it is free
+func (m *RepositoryMirrors) tryLock(mirror string) (func(), bool) {
+	lock := m.mirrorLock(mirror)
+	select {
+	case lock <- struct{}{}:
+		return func() { <-lock }, true
+	default:
+		return nil, false
+	}
+}
+
+func (m *RepositoryMirrors) mirrorLock(mirror string) chan struct{} {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	lock, ok := m.locks[mirror]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		m.locks[mirror] = lock
+	}
+	return lock
+}
+
+// isValidBranchName checks a branch name against git's rules for ref names
+func isValidBranchName(branch string) bool {
+	if branch == "" || strings.HasPrefix(branch, "-") || strings.HasPrefix(branch, "/") ||
+		strings.HasSuffix(branch, "/") || strings.HasSuffix(branch, ".") || strings.HasSuffix(branch, ".lock") {
+		return false
+	}
+	for _, sequence := range []string{"..", "//", "@{", "/."} {
+		if strings.Contains(branch, sequence) {
+			return false
+		}
+	}
+	for _, r := range branch {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(" ~^:?*[\\", r) {
+			return false
+		}
+	}
+	return !strings.HasPrefix(branch, ".")
+}
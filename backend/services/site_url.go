@@ -0,0 +1,92 @@
+package services
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// previewSeparator separates the deployment ID from the app name in a
+// preview host. App names never contain it, as sanitizing collapses
+// repeated hyphens.
+const previewSeparator = "--"
+
+// maxHostLabel is the longest label of a host name
+const maxHostLabel = 63
+
+// MaxSiteNameLength is the longest sanitized app name: one that still fits
+// in the label of a preview host after a hex deployment ID, the longest
+// prefix a label gets. The prefix of a pull request is shorter for any PR
+// number below 10^21.
+const MaxSiteNameLength = maxHostLabel - 2*len(primitive.ObjectID{}) - len(previewSeparator)
+
+// pullRequestPrefix starts the label of a pull request's preview, in
+// place of a deployment ID
+const pullRequestPrefix = "pr-"
+
+// SiteHost is what a host of the app domain asks for
+type SiteHost struct {
+	// Name is the app's sanitized name
+	Name string
+	// DeploymentID is the deployment a preview host asks for
+	DeploymentID *primitive.ObjectID
+	// PullRequest is the pull request a pull request's preview host asks
+	// for
+	PullRequest int
+}
+
+// AppURL is where the edge server serves an app's live deployment
+func AppURL(appDomain, sanitizedName string) string {
+	return fmt.Sprintf("https://%s.%s", sanitizedName, appDomain)
+}
+
+// PreviewURL is where the edge server serves one deployment of an app, for
+// as long as its files are kept
+func PreviewURL(appDomain, deploymentID, sanitizedName string) string {
+	return fmt.Sprintf("https://%s%s%s.%s", deploymentID, previewSeparator, sanitizedName, appDomain)
+}
+
+// PullRequestPreviewURL is where the edge server serves the latest build of
+// a pull request, for as long as it is open
+func PullRequestPreviewURL(appDomain string, number int, sanitizedName string) string {
+	return fmt.Sprintf("https://%s%d%s%s.%s", pullRequestPrefix, number, previewSeparator, sanitizedName, appDomain)
+}
+
+// ParseSiteHost returns what a host that is a subdomain of appDomain asks
+// for. ok is false for other hosts.
+func ParseSiteHost(appDomain, host string) (*SiteHost, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	label, found := strings.CutSuffix(host, "."+strings.ToLower(appDomain))
+	if !found || label == "" || strings.Contains(label, ".") {
+		return nil, false
+	}
+
+	id, name, isPreview := strings.Cut(label, previewSeparator)
+	if !isPreview {
+		return &SiteHost{Name: label}, true
+	}
+	if name == "" {
+		return nil, false
+	}
+
+	if number, isPullRequest := strings.CutPrefix(id, pullRequestPrefix); isPullRequest {
+		n, err := strconv.Atoi(number)
+		if err != nil || n <= 0 || strconv.Itoa(n) != number {
+			return nil, false
+		}
+		return &SiteHost{Name: name, PullRequest: n}, true
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, false
+	}
+	return &SiteHost{Name: name, DeploymentID: &objectID}, true
+}
@@ -0,0 +1,135 @@
+package services
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// semver is a parsed semantic version. Build metadata is ignored.
+type semver struct {
+	major, minor, patch int
+	prerelease          string
+}
+
+func parseSemver(version string) (semver, error) {
+	version = strings.SplitN(strings.TrimSpace(version), "+", 2)[0]
+	core, prerelease, _ := strings.Cut(version, "-")
+
+	parts := strings.Split(core, ".")
+	if len(parts) != 3 {
+		return semver{}, fmt.Errorf("invalid version %q", version)
+	}
+
+	numbers := make([]int, 3)
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil || number < 0 {
+			return semver{}, fmt.Errorf("invalid version %q", version)
+		}
+		numbers[i] = number
+	}
+
+	return semver{numbers[0], numbers[1], numbers[2], prerelease}, nil
+}
+
+// compare returns -1, 0 or 1. A pre-release sorts before its release.
+func (v semver) compare(other semver) int {
+	for _, diff := range []int{v.major - other.major, v.minor - other.minor, v.patch - other.patch} {
+		if diff < 0 {
+			return -1
+		}
+		if diff > 0 {
+			return 1
+		}
+	}
+
+	switch {
+	case v.prerelease == other.prerelease:
+		return 0
+	case v.prerelease == "":
+		return 1
+	case other.prerelease == "":
+		return -1
+	case v.prerelease < other.prerelease:
+		return -1
+	default:
+		return 1
+	}
+}
+
+func (v semver) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+	if v.prerelease != "" {
+		s += "-" + v.prerelease
+	}
+	return s
+}
+
+// satisfiesConstraint reports whether a version satisfies a pub version
+// constraint such as "^3.3.0", ">=3.19.0 <4.0.0", "3.22.3" or "any"
+func satisfiesConstraint(version, constraint string) (bool, error) {
+	constraint = strings.TrimSpace(constraint)
+	if constraint == "" || constraint == "any" {
+		return true, nil
+	}
+
+	v, err := parseSemver(version)
+	if err != nil {
+		return false, err
+	}
+
+	for _, term := range strings.Fields(constraint) {
+		ok, err := satisfiesTerm(v, term)
+		if err != nil {
+			return false, fmt.Errorf("invalid constraint %q: %v", constraint, err)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func satisfiesTerm(v semver, term string) (bool, error) {
+	if strings.HasPrefix(term, "^") {
+		min, err := parseSemver(term[1:])
+		if err != nil {
+			return false, err
+		}
+		// ^1.2.3 allows <2.0.0, ^0.2.3 allows <0.3.0
+		max := semver{major: min.major + 1}
+		if min.major == 0 {
+			max = semver{minor: min.minor + 1}
+		}
+		return v.compare(min) >= 0 && v.compare(max) < 0, nil
+	}
+
+	for _, operator := range []string{">=", "<=", ">", "<"} {
+		if !strings.HasPrefix(term, operator) {
+			continue
+		}
+		bound, err := parseSemver(term[len(operator):])
+		if err != nil {
+			return false, err
+		}
+		c := v.compare(bound)
+		switch operator {
+		case ">=":
+			return c >= 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		default:
+			return c < 0, nil
+		}
+	}
+
+	exact, err := parseSemver(term)
+	if err != nil {
+		return false, err
+	}
+	return v.compare(exact) == 0, nil
+}
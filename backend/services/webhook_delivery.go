@@ -0,0 +1,288 @@
+package services
+
+import (
+	"breezy/model"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// ErrDuplicateDelivery is returned for a webhook delivery that was
+	// already received, such as one GitHub redelivers
+	ErrDuplicateDelivery = errors.New("webhook delivery was already received")
+	// ErrDeliveryNotReplayable is returned when replaying a delivery from a
+	// repository the app is no longer built from
+	ErrDeliveryNotReplayable = errors.New("webhook delivery can't be replayed")
+)
+
+// HandleWebhook records a webhook delivery from GitHub and processes it for
+// every app built from its repository. A delivery ID that was already
+// received returns ErrDuplicateDelivery and isn't processed again.
+func (bs *BuildService) HandleWebhook(deliveryID, event string, payload []byte) (*model.WebhookDelivery, error) {
+	var summary struct {
+		Action     string `json:"action"`
+		Ref        string `json:"ref"`
+		After      string `json:"after"`
+		Repository struct {
+			Id       int64  `json:"id"`
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+		PullRequest struct {
+			Head struct {
+				Ref string `json:"ref"`
+				Sha string `json:"sha"`
+			} `json:"head"`
+		} `json:"pull_request"`
+	}
+	// What can't be read is left out of the record, processing reports it
+	json.Unmarshal(payload, &summary)
+
+	delivery := &model.WebhookDelivery{
+		Id:           primitive.NewObjectID(),
+		DeliveryId:   deliveryID,
+		Event:        event,
+		Action:       summary.Action,
+		GitHubRepoId: summary.Repository.Id,
+		Repository:   summary.Repository.FullName,
+		Ref:          summary.Ref,
+		CommitSha:    summary.After,
+		Status:       model.WebhookDeliveryStatusReceived,
+		Results:      []model.WebhookDeliveryResult{},
+		Payload:      string(payload),
+		ReceivedAt:   time.Now(),
+	}
+	if event == "pull_request" {
+		delivery.Ref = summary.PullRequest.Head.Ref
+		delivery.CommitSha = summary.PullRequest.Head.Sha
+	}
+
+	// The unique index on deliveryId makes the insert the duplicate check
+	if _, err := bs.db.Collection("webhook_deliveries").InsertOne(context.Background(), delivery); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrDuplicateDelivery
+		}
+		return nil, err
+	}
+
+	apps, err := bs.linkedApps(delivery.GitHubRepoId)
+	if err != nil {
+		bs.finishDelivery(delivery, model.WebhookDeliveryStatusFailed, fmt.Sprintf("Failed to find the apps built from the repository: %v", err))
+		return delivery, nil
+	}
+	bs.processDelivery(delivery, apps)
+	return delivery, nil
+}
+
+// GetWebhookDeliveries returns the webhook deliveries that reached the
+// user's app, newest first, with the results of that app only. Apps of
+// other users can be built from the same repository.
+func (bs *BuildService) GetWebhookDeliveries(appID, userID primitive.ObjectID, limit int64) ([]model.WebhookDelivery, error) {
+	var app model.App
+	err := bs.db.Collection("apps").FindOne(context.Background(), bson.M{"_id": appID, "userId": userID}).Decode(&app)
+	if err != nil {
+		return nil, err
+	}
+
+	filter, err := bs.appDeliveriesFilter(&app)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := bs.db.Collection("webhook_deliveries").Find(context.Background(), filter,
+		options.Find().SetSort(bson.D{{Key: "receivedAt", Value: -1}}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := []model.WebhookDelivery{}
+	if err := cursor.All(context.Background(), &deliveries); err != nil {
+		return nil, err
+	}
+	for i := range deliveries {
+		deliveries[i].Results = appDeliveryResults(deliveries[i].Results, app.Id)
+	}
+	return deliveries, nil
+}
+
+// appDeliveriesFilter matches the deliveries that reached an app: those
+// with a result for it, and those from its repository that failed before
+// any app was matched
+func (bs *BuildService) appDeliveriesFilter(app *model.App) (bson.M, error) {
+	if app.RepositoryId.IsZero() {
+		return bson.M{"results.appId": app.Id}, nil
+	}
+
+	var repository model.Repository
+	err := bs.db.Collection("repositories").FindOne(context.Background(), bson.M{"_id": app.RepositoryId}).Decode(&repository)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return bson.M{"results.appId": app.Id}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bson.M{"$or": bson.A{
+		bson.M{"results.appId": app.Id},
+		bson.M{
+			"githubRepoId": repository.GitHubRepoId,
+			"status":       model.WebhookDeliveryStatusFailed,
+			"results":      bson.M{"$size": 0},
+		},
+	}}, nil
+}
+
+// appDeliveryResults returns the results of a delivery for one app
+func appDeliveryResults(results []model.WebhookDeliveryResult, appID primitive.ObjectID) []model.WebhookDeliveryResult {
+	own := []model.WebhookDeliveryResult{}
+	for _, result := range results {
+		if result.AppId == appID {
+			own = append(own, result)
+		}
+	}
+	return own
+}
+
+// ReplayWebhookDelivery processes a delivery that reached the user's app
+// again, for that app only, and records the replay as a delivery of its own
+func (bs *BuildService) ReplayWebhookDelivery(appID, deliveryID, userID primitive.ObjectID) (*model.WebhookDelivery, error) {
+	var app model.App
+	err := bs.db.Collection("apps").FindOne(context.Background(), bson.M{"_id": appID, "userId": userID}).Decode(&app)
+	if err != nil {
+		return nil, err
+	}
+
+	filter, err := bs.appDeliveriesFilter(&app)
+	if err != nil {
+		return nil, err
+	}
+	var original model.WebhookDelivery
+	err = bs.db.Collection("webhook_deliveries").FindOne(context.Background(), bson.M{
+		"_id":  deliveryID,
+		"$and": bson.A{filter},
+	}).Decode(&original)
+	if err != nil {
+		return nil, err
+	}
+
+	// A delivery from another repository would build that repository's
+	// commits into the app
+	var repository model.Repository
+	err = bs.db.Collection("repositories").FindOne(context.Background(), bson.M{"_id": app.RepositoryId}).Decode(&repository)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrDeliveryNotReplayable
+	}
+	if err != nil {
+		return nil, err
+	}
+	if repository.GitHubRepoId != original.GitHubRepoId {
+		return nil, ErrDeliveryNotReplayable
+	}
+
+	replay := original
+	replay.Id = primitive.NewObjectID()
+	replay.DeliveryId = fmt.Sprintf("%s/replay-%s", original.DeliveryId, replay.Id.Hex())
+	replay.ReplayOf = &original.Id
+	replay.Status = model.WebhookDeliveryStatusReceived
+	replay.Message = ""
+	replay.Results = []model.WebhookDeliveryResult{}
+	replay.ReceivedAt = time.Now()
+	replay.ProcessedAt = nil
+	if _, err := bs.db.Collection("webhook_deliveries").InsertOne(context.Background(), &replay); err != nil {
+		return nil, err
+	}
+
+	logrus.Infof("Replaying webhook delivery %s for app %s", original.DeliveryId, appID.Hex())
+	bs.processDelivery(&replay, []model.App{app})
+	return &replay, nil
+}
+
+// processDelivery handles a recorded delivery's event for apps and records
+// the outcome
+func (bs *BuildService) processDelivery(delivery *model.WebhookDelivery, apps []model.App) {
+	var (
+		results []model.WebhookDeliveryResult
+		err     error
+	)
+	switch delivery.Event {
+	case "ping":
+		delivery.Results = deliveryResults(apps, "Webhook is set up")
+		bs.finishDelivery(delivery, model.WebhookDeliveryStatusProcessed, "Webhook is set up")
+		return
+	case "push", "pull_request":
+		if len(apps) == 0 {
+			bs.finishDelivery(delivery, model.WebhookDeliveryStatusIgnored, "No app is built from the repository")
+			return
+		}
+	default:
+		message := fmt.Sprintf("%s events aren't handled", delivery.Event)
+		delivery.Results = deliveryResults(apps, message)
+		bs.finishDelivery(delivery, model.WebhookDeliveryStatusIgnored, message)
+		return
+	}
+
+	if delivery.Event == "push" {
+		var event model.GitHubWebhookPayload
+		if err = json.Unmarshal([]byte(delivery.Payload), &event); err == nil {
+			results, err = bs.HandlePushEvent(&event, apps)
+		}
+	} else {
+		var event model.GitHubPullRequestEvent
+		if err = json.Unmarshal([]byte(delivery.Payload), &event); err == nil {
+			results, err = bs.HandlePullRequestEvent(&event, apps)
+		}
+	}
+
+	delivery.Results = results
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to process %s delivery %s of %s", delivery.Event, delivery.DeliveryId, delivery.Repository)
+		bs.finishDelivery(delivery, model.WebhookDeliveryStatusFailed, err.Error())
+		return
+	}
+
+	queued := 0
+	for _, result := range results {
+		if result.DeploymentId != nil {
+			queued++
+		}
+	}
+	bs.finishDelivery(delivery, model.WebhookDeliveryStatusProcessed, fmt.Sprintf("Processed for %d apps, %d builds queued", len(results), queued))
+}
+
+// finishDelivery stores the outcome of processing a delivery
+func (bs *BuildService) finishDelivery(delivery *model.WebhookDelivery, status model.WebhookDeliveryStatus, message string) {
+	now := time.Now()
+	delivery.Status = status
+	delivery.Message = message
+	delivery.ProcessedAt = &now
+	if delivery.Results == nil {
+		delivery.Results = []model.WebhookDeliveryResult{}
+	}
+
+	_, err := bs.db.Collection("webhook_deliveries").UpdateOne(context.Background(), bson.M{"_id": delivery.Id}, bson.M{
+		"$set": bson.M{
+			"status":      delivery.Status,
+			"message":     delivery.Message,
+			"results":     delivery.Results,
+			"processedAt": delivery.ProcessedAt,
+		},
+	})
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to record the outcome of webhook delivery %s", delivery.DeliveryId)
+	}
+}
+
+// deliveryResults gives every app the same outcome of a delivery
+func deliveryResults(apps []model.App, message string) []model.WebhookDeliveryResult {
+	results := make([]model.WebhookDeliveryResult, 0, len(apps))
+	for _, app := range apps {
+		results = append(results, model.WebhookDeliveryResult{AppId: app.Id, Message: message})
+	}
+	return results
+}
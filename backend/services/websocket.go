@@ -3,18 +3,26 @@ package services
 import (
 	"breezy/logger"
 	"breezy/middleware"
+	"context"
 	"encoding/json"
 	"fmt"
 	"sync"
 	"time"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 var log = logger.Logger()
 
+// buildUpdatesChannel is the Redis pub/sub channel build updates are fanned
+// out on, so clients connected to any server process receive them
+const buildUpdatesChannel = "build_updates"
+
 type WebSocketService struct {
 	clients    map[string]*Client
 	broadcast  chan BuildUpdate
@@ -22,6 +30,17 @@ type WebSocketService struct {
 	unregister chan *Client
 	mutex      sync.RWMutex
 	jwtSecret  string
+	redis      *redis.Client
+	onCancel   CancelHandler
+}
+
+// CancelHandler cancels a user's build for a deployment
+type CancelHandler func(deploymentID, userID primitive.ObjectID) error
+
+// ClientMessage is a message sent by a client over the WebSocket
+type ClientMessage struct {
+	Type         string `json:"type"`
+	DeploymentID string `json:"deploymentId"`
 }
 
 type Client struct {
@@ -34,37 +53,46 @@ type Client struct {
 }
 
 type BuildUpdate struct {
-	Type      string    `json:"type"`
-	AppID     string    `json:"appId"`
-	UserID    string    `json:"userId"`
-	Status    string    `json:"status"`
-	Message   string    `json:"message"`
-	Progress  int       `json:"progress,omitempty"`
-	Data      any       `json:"data,omitempty"`
-	Timestamp time.Time `json:"timestamp"`
+	Type          string    `json:"type"`
+	AppID         string    `json:"appId"`
+	UserID        string    `json:"userId"`
+	DeploymentID  string    `json:"deploymentId,omitempty"`
+	Status        string    `json:"status"`
+	Message       string    `json:"message"`
+	Progress      int       `json:"progress,omitempty"`
+	QueuePosition int       `json:"queuePosition,omitempty"`
+	Data          any       `json:"data,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
 }
 
 type BuildStatus string
 
 const (
-	BuildStatusPending  BuildStatus = "pending"
-	BuildStatusCloning  BuildStatus = "cloning"
-	BuildStatusBuilding BuildStatus = "building"
-	BuildStatusSuccess  BuildStatus = "success"
-	BuildStatusFailed   BuildStatus = "failed"
+	BuildStatusPending    BuildStatus = "pending"
+	BuildStatusCloning    BuildStatus = "cloning"
+	BuildStatusBuilding   BuildStatus = "building"
+	BuildStatusSuccess    BuildStatus = "success"
+	BuildStatusFailed     BuildStatus = "failed"
+	BuildStatusCancelled  BuildStatus = "cancelled"
+	BuildStatusSuperseded BuildStatus = "superseded"
 )
 
-func NewWebSocketService() *WebSocketService {
+func NewWebSocketService(redis *redis.Client) *WebSocketService {
 	return &WebSocketService{
 		clients:    make(map[string]*Client),
 		broadcast:  make(chan BuildUpdate),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		jwtSecret:  middleware.JWTSecret,
+		redis:      redis,
 	}
 }
 
 func (ws *WebSocketService) Start() {
+	if ws.redis != nil {
+		go ws.subscribe()
+	}
+
 	for {
 		select {
 		case client := <-ws.register:
@@ -100,8 +128,43 @@ func (ws *WebSocketService) Start() {
 	}
 }
 
+// SetCancelHandler sets the handler for "cancel" messages from clients
+func (ws *WebSocketService) SetCancelHandler(handler CancelHandler) {
+	ws.onCancel = handler
+}
+
+// BroadcastUpdate sends an update to the user's connected clients. When
+// Redis is configured the update is published so every server process,
+// including the one running the build worker, delivers it to its clients.
 func (ws *WebSocketService) BroadcastUpdate(update BuildUpdate) {
-	ws.broadcast <- update
+	if ws.redis == nil {
+		ws.broadcast <- update
+		return
+	}
+
+	data := ws.marshalUpdate(update)
+	if data == nil {
+		return
+	}
+
+	if err := ws.redis.Publish(context.Background(), buildUpdatesChannel, data).Err(); err != nil {
+		log.WithError(err).Error("Failed to publish build update")
+	}
+}
+
+// subscribe relays updates published by any process to local clients
+func (ws *WebSocketService) subscribe() {
+	pubsub := ws.redis.Subscribe(context.Background(), buildUpdatesChannel)
+	defer pubsub.Close()
+
+	for message := range pubsub.Channel() {
+		var update BuildUpdate
+		if err := json.Unmarshal([]byte(message.Payload), &update); err != nil {
+			log.WithError(err).Error("Failed to unmarshal build update")
+			continue
+		}
+		ws.broadcast <- update
+	}
 }
 
 func (ws *WebSocketService) marshalUpdate(update BuildUpdate) []byte {
@@ -190,7 +253,7 @@ func (c *Client) readPump() {
 	})
 
 	for {
-		_, _, err := c.Conn.ReadMessage()
+		_, data, err := c.Conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.WithError(err).Error("WebSocket read error")
@@ -199,6 +262,64 @@ func (c *Client) readPump() {
 			}
 			break
 		}
+
+		var message ClientMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			c.sendError("Invalid message")
+			continue
+		}
+		c.handleMessage(message)
+	}
+}
+
+func (c *Client) handleMessage(message ClientMessage) {
+	switch message.Type {
+	case "cancel":
+		if c.service.onCancel == nil {
+			c.sendError("Cancelling builds is not available")
+			return
+		}
+
+		deploymentID, err := primitive.ObjectIDFromHex(message.DeploymentID)
+		if err != nil {
+			c.sendError("Invalid deployment ID format")
+			return
+		}
+		userID, err := primitive.ObjectIDFromHex(c.UserID)
+		if err != nil {
+			c.sendError("Invalid user ID")
+			return
+		}
+
+		// The "cancelled" build update is broadcast on success
+		if err := c.service.onCancel(deploymentID, userID); err != nil {
+			if err == mongo.ErrNoDocuments {
+				c.sendError("Deployment not found")
+				return
+			}
+			log.WithError(err).Errorf("Failed to cancel deployment %s for client %s", message.DeploymentID, c.ID)
+			c.sendError(fmt.Sprintf("Failed to cancel deployment: %v", err))
+		}
+	default:
+		c.sendError(fmt.Sprintf("Unknown message type %q", message.Type))
+	}
+}
+
+// sendError sends an error message to this client only
+func (c *Client) sendError(message string) {
+	update := BuildUpdate{
+		Type:      "error",
+		AppID:     c.AppID,
+		UserID:    c.UserID,
+		Status:    "error",
+		Message:   message,
+		Timestamp: time.Now(),
+	}
+
+	select {
+	case c.Send <- c.service.marshalUpdate(update):
+	default:
+		log.Warnf("Failed to send error message to client: %s", c.ID)
 	}
 }
 
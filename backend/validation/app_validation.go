@@ -1,6 +1,7 @@
 package validation
 
 import (
+	"breezy/model"
 	"breezy/utils"
 	"strings"
 
@@ -20,6 +21,37 @@ type CreateAppRequest struct {
 type DeployAppRequest struct {
 	RepoURL string `json:"repoURL" validate:"required,url"`
 	Branch  string `json:"branch" validate:"max=50"`
+	// CommitSha builds a specific commit instead of the tip of the branch
+	CommitSha string `json:"commitSha" validate:"omitempty,hexadecimal,len=40"`
+	// NoCache redeploys without the app's dependency cache
+	NoCache bool `json:"noCache"`
+}
+
+// UpdateAppRequest represents the request body for updating an app. Fields
+// left out of the request are not changed.
+type UpdateAppRequest struct {
+	Description   *string               `json:"description" validate:"omitempty,max=500"`
+	BuildTimeouts *BuildTimeoutsRequest `json:"buildTimeouts"`
+	// Framework selects how the app is built; "auto" detects it from the
+	// repository
+	Framework *string `json:"framework" validate:"omitempty,oneof=auto flutter static node hugo"`
+	// FlutterVersion pins the Flutter version or channel Flutter builds
+	// use; "" leaves the choice to the repository
+	FlutterVersion *string `json:"flutterVersion" validate:"omitempty,max=50"`
+	// Branch is the branch deployed when pushed to
+	Branch *string `json:"branch" validate:"omitempty,min=1,max=50"`
+	// AutoDeploy turns deploying on push on or off
+	AutoDeploy *bool `json:"autoDeploy"`
+}
+
+// BuildTimeoutsRequest overrides the server's build timeouts for an app, in
+// seconds. Zero keeps the server default.
+type BuildTimeoutsRequest struct {
+	TotalSeconds        int `json:"totalSeconds" validate:"min=0,max=7200"`
+	CloneSeconds        int `json:"cloneSeconds" validate:"min=0,max=3600"`
+	DependenciesSeconds int `json:"dependenciesSeconds" validate:"min=0,max=3600"`
+	BuildSeconds        int `json:"buildSeconds" validate:"min=0,max=7200"`
+	UploadSeconds       int `json:"uploadSeconds" validate:"min=0,max=3600"`
 }
 
 // ValidateCreateAppRequest validates the create app request
@@ -69,6 +101,7 @@ func ValidateDeployAppRequest(c *fiber.Ctx) error {
 	if request.Branch == "" {
 		request.Branch = "main" // Set default
 	}
+	request.CommitSha = strings.ToLower(request.CommitSha)
 
 	// Validate GitHub URL format
 	if !isValidGitHubURL(request.RepoURL) {
@@ -80,6 +113,29 @@ func ValidateDeployAppRequest(c *fiber.Ctx) error {
 	return c.Next()
 }
 
+// ValidateUpdateAppRequest validates the update app request
+func ValidateUpdateAppRequest(c *fiber.Ctx) error {
+	var request UpdateAppRequest
+
+	if err := c.BodyParser(&request); err != nil {
+		return utils.BadRequestResponse(c, "Invalid request body")
+	}
+
+	// Validate using struct tags
+	validate := GetValidator()
+	if err := validate.Struct(request); err != nil {
+		return utils.BadRequestResponse(c, "Validation failed: "+err.Error())
+	}
+
+	if request.FlutterVersion != nil && *request.FlutterVersion != "" && !isValidFlutterVersion(*request.FlutterVersion) {
+		return utils.BadRequestResponse(c, "Invalid Flutter version: use a release such as 3.24.3 or a channel (stable, beta, master, main)")
+	}
+
+	// Store validated request in context for controller to use
+	c.Locals("validated_request", request)
+	return c.Next()
+}
+
 // ValidateAppID validates that the app ID parameter is valid
 func ValidateAppID(c *fiber.Ctx) error {
 	appID := c.Params("id")
@@ -143,3 +199,9 @@ func isValidGitHubURL(url string) bool {
 
 	return true
 }
+
+// isValidFlutterVersion checks if the version is a Flutter release or
+// channel
+func isValidFlutterVersion(version string) bool {
+	return model.IsFlutterVersion(version)
+}
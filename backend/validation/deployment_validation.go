@@ -45,3 +45,22 @@ func ValidateDeploymentOwnership(c *fiber.Ctx) error {
 
 	return c.Next()
 }
+
+// ValidateAppDeploymentID validates the deployment ID parameter of routes
+// nested under an app
+func ValidateAppDeploymentID(c *fiber.Ctx) error {
+	deploymentID := c.Params("deploymentId")
+
+	if deploymentID == "" {
+		return utils.BadRequestResponse(c, "Deployment ID is required")
+	}
+
+	deploymentObjectID, err := primitive.ObjectIDFromHex(deploymentID)
+	if err != nil {
+		return utils.BadRequestResponse(c, "Invalid deployment ID format")
+	}
+
+	c.Locals("deployment_id", deploymentObjectID)
+
+	return c.Next()
+}
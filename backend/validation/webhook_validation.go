@@ -5,42 +5,75 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-// ValidateGitHubWebhook validates GitHub webhook requests
-func ValidateGitHubWebhook(c *fiber.Ctx) error {
-	// Get the signature from headers
-	signature := c.Get("X-Hub-Signature-256")
-	if signature == "" {
-		return utils.UnauthorizedResponse(c, "Missing GitHub signature")
-	}
+// WebhookSecretFunc returns the secret the deliveries of a webhook are
+// signed with, "" if there is no such webhook. target is what the webhook
+// is installed on, as in X-GitHub-Hook-Installation-Target-Type, and
+// githubRepoID the repository a delivery is from, 0 if it names none.
+type WebhookSecretFunc func(target string, githubRepoID int64) (string, error)
 
-	// Get the webhook secret (you should store this in environment variables)
-	webhookSecret := "your-webhook-secret" // TODO: Get from environment
+// ValidateGitHubWebhook validates GitHub webhook requests against the
+// secret of the webhook they are from: the GitHub App's or that of the
+// repository they are from
+func ValidateGitHubWebhook(webhookSecret WebhookSecretFunc) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		// Get the signature from headers
+		signature := c.Get("X-Hub-Signature-256")
+		if signature == "" {
+			return utils.UnauthorizedResponse(c, "Missing GitHub signature")
+		}
 
-	// Get the raw body
-	body := c.Body()
-	if len(body) == 0 {
-		return utils.BadRequestResponse(c, "Empty webhook body")
-	}
+		// Get the raw body
+		body := c.Body()
+		if len(body) == 0 {
+			return utils.BadRequestResponse(c, "Empty webhook body")
+		}
 
-	// Validate the signature
-	if !validateGitHubSignature([]byte(signature), body, webhookSecret) {
-		return utils.UnauthorizedResponse(c, "Invalid GitHub signature")
-	}
+		// Every delivery of a repository webhook names the repository. The
+		// GitHub App's webhook also delivers events of the app itself, such
+		// as installations.
+		target := c.Get("X-GitHub-Hook-Installation-Target-Type")
+		var delivery struct {
+			Repository *struct {
+				Id int64 `json:"id"`
+			} `json:"repository"`
+		}
+		if err := json.Unmarshal(body, &delivery); err != nil || (delivery.Repository == nil && target != "integration") {
+			return utils.BadRequestResponse(c, "Invalid webhook payload")
+		}
+		var githubRepoID int64
+		if delivery.Repository != nil {
+			githubRepoID = delivery.Repository.Id
+		}
 
-	// Parse the webhook payload
-	var payload map[string]interface{}
-	if err := c.BodyParser(&payload); err != nil {
-		return utils.BadRequestResponse(c, "Invalid webhook payload")
-	}
+		secret, err := webhookSecret(target, githubRepoID)
+		if err != nil {
+			logrus.WithError(err).Errorf("Failed to get the webhook secret of repository %d", githubRepoID)
+			return utils.InternalServerErrorResponse(c, "Failed to validate webhook")
+		}
 
-	// Store validated payload in context for controller to use
-	c.Locals("webhook_payload", payload)
-	return c.Next()
+		// Validate the signature
+		if secret == "" || !validateGitHubSignature([]byte(signature), body, secret) {
+			return utils.UnauthorizedResponse(c, "Invalid GitHub signature")
+		}
+
+		// Parse the webhook payload
+		var payload map[string]interface{}
+		if err := c.BodyParser(&payload); err != nil {
+			return utils.BadRequestResponse(c, "Invalid webhook payload")
+		}
+
+		// Store validated payload in context for controller to use
+		c.Locals("webhook_payload", payload)
+		return c.Next()
+	}
 }
 
 // validateGitHubSignature validates the GitHub webhook signature
@@ -55,3 +88,22 @@ func validateGitHubSignature(signature, body []byte, secret string) bool {
 
 	return hmac.Equal([]byte(signatureValue), []byte(expectedSignature))
 }
+
+// ValidateAppWebhookDeliveryID validates the webhook delivery ID parameter
+// of routes nested under an app
+func ValidateAppWebhookDeliveryID(c *fiber.Ctx) error {
+	deliveryID := c.Params("deliveryId")
+
+	if deliveryID == "" {
+		return utils.BadRequestResponse(c, "Delivery ID is required")
+	}
+
+	deliveryObjectID, err := primitive.ObjectIDFromHex(deliveryID)
+	if err != nil {
+		return utils.BadRequestResponse(c, "Invalid delivery ID format")
+	}
+
+	c.Locals("delivery_id", deliveryObjectID)
+
+	return c.Next()
+}
@@ -3,88 +3,142 @@ package worker
 import (
 	"breezy/config"
 	"breezy/model"
+	"breezy/services"
 	"context"
-	"encoding/json"
 	"time"
 
-	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type Worker struct {
-	db        *mongo.Database
-	redis     *redis.Client
-	config    *config.Environment
-	queueName string
+	id           string
+	db           *mongo.Database
+	queue        *services.BuildQueue
+	buildService *services.BuildService
+	config       *config.Environment
 }
 
-func NewWorker(db *mongo.Database, redis *redis.Client, config *config.Environment) *Worker {
+func NewWorker(db *mongo.Database, queue *services.BuildQueue, buildService *services.BuildService, config *config.Environment) *Worker {
 	return &Worker{
-		db:        db,
-		redis:     redis,
-		config:    config,
-		queueName: "build_jobs",
+		id:           uuid.New().String(),
+		db:           db,
+		queue:        queue,
+		buildService: buildService,
+		config:       config,
 	}
 }
 
 func (w *Worker) Start() {
-	logrus.Info("Starting build worker...")
+	logrus.WithField("worker_id", w.id).Info("Starting build worker...")
+
+	// Register before taking any job so our in-flight jobs are never
+	// mistaken for orphans
+	w.beat()
+	go w.heartbeat()
+	w.buildService.CleanDependencyCache()
+	go w.buildService.WatchCancellations(context.Background())
+	go w.pruneMirrors()
+
+	// Local slots only bound this process; the queue enforces the global
+	// and per-user limits across all workers
+	slots := make(chan struct{}, max(w.config.Build.MaxConcurrent, 1))
 
 	for {
+		slots <- struct{}{}
+
 		// Poll for jobs
-		job, err := w.getNextJob()
+		job, payload, err := w.getNextJob()
 		if err != nil {
+			<-slots
 			logrus.WithError(err).Error("Failed to get next job")
 			time.Sleep(5 * time.Second)
 			continue
 		}
 
-		if job != nil {
-			w.processJob(job)
-		} else {
-			// No jobs available, wait a bit
+		if job == nil {
+			// No jobs available, or every slot is taken; wait a bit
+			<-slots
 			time.Sleep(1 * time.Second)
+			continue
 		}
+
+		// Everyone behind this job just moved up
+		w.buildService.BroadcastQueuePositions()
+
+		go func() {
+			defer func() { <-slots }()
+			w.processJob(job)
+			w.ackJob(job, payload)
+		}()
 	}
 }
 
-func (w *Worker) getNextJob() (*model.BuildJob, error) {
+func (w *Worker) getNextJob() (*model.BuildJob, string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	// Get job from Redis queue
-	result, err := w.redis.BLPop(ctx, 1*time.Second, w.queueName).Result()
-	if err != nil {
-		if err == redis.Nil {
-			return nil, nil // No jobs available
-		}
-		return nil, err
-	}
+	return w.queue.Dequeue(ctx, w.id)
+}
+
+func (w *Worker) processJob(job *model.BuildJob) {
+	logrus.WithField("job_id", job.Id).Info("Processing build job")
 
-	if len(result) < 2 {
-		return nil, nil
+	if err := w.buildService.RunJob(job); err != nil {
+		logrus.WithError(err).WithField("job_id", job.Id).Error("Build job failed")
+		return
 	}
 
-	// Parse job data
-	var job model.BuildJob
-	if err := json.Unmarshal([]byte(result[1]), &job); err != nil {
-		logrus.WithError(err).Error("Failed to unmarshal job")
-		return nil, err
+	logrus.WithField("job_id", job.Id).Info("Build job completed")
+}
+
+func (w *Worker) ackJob(job *model.BuildJob, payload string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := w.queue.Ack(ctx, w.id, job, payload); err != nil {
+		logrus.WithError(err).WithField("job_id", job.Id).Error("Failed to ack build job")
 	}
+}
+
+// heartbeat keeps the worker registered and re-queues jobs held by workers
+// that have stopped sending heartbeats
+func (w *Worker) heartbeat() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		w.beat()
 
-	return &job, nil
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		requeued, err := w.queue.RequeueOrphans(ctx)
+		cancel()
+		if err != nil {
+			logrus.WithError(err).Error("Failed to requeue orphaned build jobs")
+		} else if requeued > 0 {
+			logrus.Warnf("Requeued %d orphaned build job(s)", requeued)
+		}
+	}
 }
 
-func (w *Worker) processJob(job *model.BuildJob) {
-	logrus.WithField("job_id", job.Id).Info("Processing build job")
+func (w *Worker) beat() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	// TODO: Implement build job processing
-	// - Clone repository
-	// - Build Flutter app
-	// - Upload to storage
-	// - Update deployment status
-	// - Update app URL
+	if err := w.queue.Heartbeat(ctx, w.id); err != nil {
+		logrus.WithError(err).Error("Failed to send worker heartbeat")
+	}
+}
 
-	logrus.WithField("job_id", job.Id).Info("Build job completed")
+// pruneMirrors regularly removes repository mirrors that are no longer
+// built
+func (w *Worker) pruneMirrors() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		w.buildService.PruneMirrors()
+		<-ticker.C
+	}
 }